@@ -4,16 +4,43 @@ import (
 	"net/http"
 )
 
+const (
+	// IdentityKey is the Connection storage key ConnToRequest should use to store who the connection belongs to (like a user ID).
+	// The value has to be a string.
+	// The hub stamps it onto the Sender of every message the connection sends.
+	IdentityKey = "conductor.identity"
+
+	// ConnectionIDKey is the Connection storage key of the ID the server assigned to the connection (the same as Connection.ID).
+	// The ID is used as the Sender of messages from connections that don't have an IdentityKey.
+	ConnectionIDKey = "conductor.id"
+)
+
+// identityOf returns the identity the hub stamps onto messages from the connection.
+func identityOf(conn Connection) string {
+	if identity := GetString(conn, IdentityKey); identity != "" {
+		return identity
+	}
+	return conn.ID()
+}
+
 // ConnectionAuth is the based interface for handling authentication and authorization.
 // This is used for new HTTP requests that upgrade a websocket and the permissions to channels.
 // Use this for checking for auth tokens and such to ensure only real clients can connect.
 // and that connections have the right permissions to write or bind to a channel.
+// The hub calls it from several goroutines at once, so it has to be safe for concurrent use.
 type ConnectionAuth interface {
-	IsValid(r *http.Request) bool                    // IsValid is called on every HTTP upgrade request and should be used to validate auth tokens.
-	ConnToRequest(r *http.Request, conn Connection)  // ConnToRequest is called so you can map your HTTP request (like the auth token) to a current connection.
-	CanBind(conn Connection, message *Message) bool  // CanBind is called on every bind request, so optimizing it is highly recommended.
-	CanWrite(conn Connection, message *Message) bool // CanWrite is called on every write request, so optimizing it is highly recommended.
-	IsSister(r *http.Request) bool                   // IsSister is called on every HTTP upgrade request and should be used to check if an incoming connection is from a sister node or not.
+	IsValid(r *http.Request) bool                     // IsValid is called on every HTTP upgrade request and should be used to validate auth tokens.
+	ConnToRequest(r *http.Request, conn Connection)   // ConnToRequest is called so you can map your HTTP request (like the auth token) to a current connection.
+	CanBind(conn Connection, message *Message) bool   // CanBind is called on every bind request, so optimizing it is highly recommended. The channel name can be a pattern (see IsPattern).
+	CanWrite(conn Connection, message *Message) bool  // CanWrite is called on every write request, so optimizing it is highly recommended.
+	CanDirect(conn Connection, message *Message) bool // CanDirect is called on every direct message, so optimizing it is highly recommended.
+	IsSister(r *http.Request) bool                    // IsSister is called on every HTTP upgrade request and should be used to check if an incoming connection is from a sister node or not.
+}
+
+// PrivateChannelAuth is an optional interface a ConnectionAuth can implement to let connections bind to private channels
+// (see ChannelPolicy.Private). Without it nobody can bind to a private channel.
+type PrivateChannelAuth interface {
+	CanBindPrivate(conn Connection, message *Message) bool // CanBindPrivate is called after CanBind on every bind to a private channel.
 }
 
 // SimpleAuth is the default implmentation of ConnectionAuth.
@@ -60,6 +87,12 @@ func (s *SimpleAuth) CanWrite(conn Connection, message *Message) bool {
 	return false
 }
 
+// CanDirect should check if a connection has rights to send a direct message to the connection or identity in the channel name.
+// It accepts every direct message.
+func (s *SimpleAuth) CanDirect(conn Connection, message *Message) bool {
+	return true
+}
+
 // IsSister should check if a connection is a sister node or not.
 // This example just looks for the header is_sister and respects that.
 // This should be a much more robust check in production.
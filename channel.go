@@ -0,0 +1,50 @@
+package conductor
+
+// channel is the state the hub keeps for each channel.
+type channel struct {
+	// the connections bound to this channel.
+	connections []Connection
+
+	// the sequence number of the last write to this channel.
+	sequence uint64
+
+	// how the channel behaves, from the ChannelPolicyProvider when the channel was created.
+	policy ChannelPolicy
+}
+
+// add binds the connection to the channel.
+func (ch *channel) add(conn Connection) {
+	ch.connections = append(ch.connections, conn)
+}
+
+// has checks if the connection is bound to the channel.
+func (ch *channel) has(conn Connection) bool {
+	for _, c := range ch.connections {
+		if c == conn {
+			return true
+		}
+	}
+	return false
+}
+
+// full checks if the channel has as many connections as its policy allows.
+func (ch *channel) full() bool {
+	return ch.policy.MaxSubscribers > 0 && len(ch.connections) >= ch.policy.MaxSubscribers
+}
+
+// remove unbinds the connection from the channel. It returns false if the connection wasn't bound.
+func (ch *channel) remove(conn Connection) bool {
+	for i, c := range ch.connections {
+		if c == conn {
+			ch.connections = append(ch.connections[:i], ch.connections[i+1:]...)
+			return true
+		}
+	}
+	return false
+}
+
+// nextSequence returns the sequence number for a new write to this channel.
+func (ch *channel) nextSequence() uint64 {
+	ch.sequence++
+	return ch.sequence
+}
@@ -1,20 +1,55 @@
 package conductor
 
 import (
+	"crypto/tls"
+	"errors"
 	"io"
 	"log"
 	"net"
 	"net/http"
 	"net/url"
+	"sync"
+	"time"
 
 	"github.com/gorilla/websocket"
 )
 
 const (
 	bufferSize = 1024
+
+	// how many rejected messages a client holds onto for the Errors channel.
+	errorBufferSize = 16
 )
 
-//Client is basic websocket connection.
+// ErrAckTimeout is returned by the Sync methods of Client when the server didn't answer in time.
+var ErrAckTimeout = errors.New("conductor: timed out waiting for ack")
+
+// clientTransport is what a Client sends and receives encoded messages over.
+type clientTransport interface {
+	readMessage() ([]byte, error)
+	writeMessage(codec Codec, buf []byte) error
+	close() error
+}
+
+// wsTransport is the websocket clientTransport.
+type wsTransport struct {
+	ws *websocket.Conn
+}
+
+func (t *wsTransport) readMessage() ([]byte, error) {
+	_, buf, err := t.ws.ReadMessage()
+	return buf, err
+}
+
+func (t *wsTransport) writeMessage(codec Codec, buf []byte) error {
+	return t.ws.WriteMessage(codec.FrameType(), buf)
+}
+
+func (t *wsTransport) close() error {
+	return t.ws.Close()
+}
+
+//Client is basic websocket (or raw TCP) connection.
 type Client struct {
 	// we hold on to the url for when/if we need to reconnect.
 	url *url.URL
@@ -22,44 +57,139 @@ type Client struct {
 	// we hold on to the headers for reconnecting as well.
 	headers http.Header
 
-	// the underlining  websocket connection we need to hold on it.
-	ws *websocket.Conn
+	// the underlining connection we need to hold on it, a websocket or a raw TCP connection.
+	conn clientTransport
+
+	// the codec the server negotiated for encoding messages.
+	codec Codec
+
+	// the decode limits, which let bodies be as big as the MaxMessageSize of the options.
+	limits DecodeLimits
 
+	// the websocket only allows one writer at a time.
+	writeMu sync.Mutex
+
+	// the Sync calls waiting on an answer from the server, by the Uuid of the message they sent.
+	pendingMu sync.Mutex
+	pending   map[string]chan *Message
+
+	// the messages read off the connection that Read hasn't taken yet. The reader never waits on Read,
+	// so acks keep getting to the Sync calls even when nobody is reading.
+	inboxMu sync.Mutex
+	inbox   []*Message
+
+	// signaled when a message lands in the inbox, and closed once the connection is closed.
+	inboxReady chan struct{}
+
+	// Read gets the messages from the server, other than the answers to Sync calls and rejected messages.
+	// Messages wait in memory until they are read, so keep reading them.
 	Read <-chan *Message
+
+	// Errors gets the messages the server rejected. Errors are dropped if nobody is reading them.
+	Errors <-chan *ProtocolError
 }
 
 // NewClient allocates and returns a new channel
 // ServerUrl is the server url to connect to.
 func NewClient(serverURL string) (*Client, error) {
+	return NewClientWithCodec(serverURL, &BinaryCodec{})
+}
+
+// NewClientWithCodec is like NewClient, but offers the codec provided to the server.
+// If the server doesn't support the codec, the client falls back to legacy binary frames
+// (or the BinaryCodec on raw TCP).
+func NewClientWithCodec(serverURL string, codec Codec) (*Client, error) {
+	return NewClientWithTLS(serverURL, codec, nil)
+}
+
+// NewClientWithTLS is like NewClientWithCodec, but uses the TLS config for tls:// URLs.
+// serverURL can be a websocket URL, or a tcp:// or tls:// URL for a server listening with ListenTCP.
+func NewClientWithTLS(serverURL string, codec Codec, config *tls.Config) (*Client, error) {
+	return NewClientWithOptions(serverURL, ClientOptions{Codec: codec, TLSConfig: config})
+}
+
+// ClientOptions are the settings of a Client. A zero field uses the default.
+type ClientOptions struct {
+	Codec          Codec       // Codec is offered to the server. It defaults to the BinaryCodec.
+	TLSConfig      *tls.Config // TLSConfig is used for tls:// URLs.
+	MaxMessageSize int64       // MaxMessageSize is the biggest frame the client reads from the server, in bytes. Match it to the server's.
+}
+
+// NewClientWithOptions is like NewClient, but with the settings in the options.
+// A frame from the server bigger than the MaxMessageSize closes the connection.
+func NewClientWithOptions(serverURL string, options ClientOptions) (*Client, error) {
 	u, err := url.Parse(serverURL)
 	if err != nil {
 		return nil, err
 	}
+	codec := options.Codec
+	if codec == nil {
+		codec = &BinaryCodec{}
+	}
+	if options.MaxMessageSize <= 0 {
+		options.MaxMessageSize = defaultMaxMessageSize
+	}
+	limits := DefaultDecodeLimits
+	limits.MaxBodySize = int(options.MaxMessageSize)
 
 	header := make(http.Header)
-	header.Add("Sec-WebSocket-Protocol", "chat, superchat")
+	header.Add("Sec-WebSocket-Protocol", codec.Name())
 	header.Add("Origin", u.String())
 
-	conn, err := net.Dial("tcp", u.Host)
-	if err != nil {
-		return nil, err
-	}
-	ws, _, err := websocket.NewClient(conn, u, header, bufferSize, bufferSize)
-	if err != nil {
-		return nil, err
+	var transport clientTransport
+	if isTCPURL(u) {
+		conn, r, picked, err := dialTCP(u, header, options.TLSConfig, codec)
+		if err != nil {
+			return nil, err
+		}
+		transport, codec = newTCPTransport(conn, r, options.MaxMessageSize), picked
+	} else {
+		conn, err := net.Dial("tcp", u.Host)
+		if err != nil {
+			return nil, err
+		}
+		ws, _, err := websocket.NewClient(conn, u, header, bufferSize, bufferSize)
+		if err != nil {
+			return nil, err
+		}
+		ws.SetReadLimit(options.MaxMessageSize)
+		transport, codec = &wsTransport{ws: ws}, negotiatedCodec(ws)
 	}
 
 	channel := make(chan *Message)
-	c := &Client{ws: ws, url: u, headers: header, Read: channel}
+	errs := make(chan *ProtocolError, errorBufferSize)
+	c := &Client{conn: transport, url: u, headers: header, codec: codec, limits: limits, Read: channel, Errors: errs,
+		pending: make(map[string]chan *Message), inboxReady: make(chan struct{}, 1)}
 
+	go c.deliver(channel)
 	go func() {
+		defer close(c.inboxReady)
 		for {
-			message := c.decodeMessage()
-			if message == nil {
-				c.ws.Close()
+			buf, err := c.conn.readMessage()
+			if err != nil {
+				c.conn.close()
 				break
-			} else {
-				channel <- message
+			}
+			message, err := unmarshalLimits(c.codec, buf, c.limits)
+			if err != nil {
+				continue // skip frames that don't decode.
+			}
+			if c.answerPending(message) {
+				continue
+			}
+			if message.Opcode == ErrorOpcode {
+				select {
+				case errs <- ParseProtocolError(message):
+				default:
+				}
+				continue
+			}
+			c.inboxMu.Lock()
+			c.inbox = append(c.inbox, message)
+			c.inboxMu.Unlock()
+			select {
+			case c.inboxReady <- struct{}{}:
+			default:
 			}
 		}
 	}()
@@ -67,35 +197,96 @@ func NewClient(serverURL string) (*Client, error) {
 	return c, nil
 }
 
+// deliver hands the messages in the inbox to Read, oldest first. It returns once the connection is closed
+// and everything read off it has been delivered.
+func (c *Client) deliver(read chan<- *Message) {
+	for {
+		_, open := <-c.inboxReady
+		c.inboxMu.Lock()
+		messages := c.inbox
+		c.inbox = nil
+		c.inboxMu.Unlock()
+		for _, message := range messages {
+			read <- message
+		}
+		if !open {
+			return
+		}
+	}
+}
+
 //Bind is used to send a bind request to a channel
 func (c *Client) Bind(channelName string) {
-	c.write(&Message{Opcode: BindOpcode, ChannelName: channelName, Uuid: newUUID()})
+	c.send(&Message{Opcode: BindOpcode, ChannelName: channelName, Uuid: newUUID()})
 }
 
 //Unbind is used to send an unbind request to a channel
 func (c *Client) Unbind(channelName string) {
-	c.write(&Message{Opcode: UnbindOpcode, ChannelName: channelName, Uuid: newUUID()})
+	c.send(&Message{Opcode: UnbindOpcode, ChannelName: channelName, Uuid: newUUID()})
 }
 
 //Write to send a message to a channel
 func (c *Client) Write(channelName string, messageBody []byte) {
-	c.write(&Message{Opcode: WriteOpcode, ChannelName: channelName, Uuid: newUUID(), Body: messageBody})
+	c.send(&Message{Opcode: WriteOpcode, ChannelName: channelName, Uuid: newUUID(), Body: messageBody})
+}
+
+//BindSync is like Bind, but waits for the server to accept the bind.
+//A refused bind returns a *ProtocolError, no answer in time returns ErrAckTimeout and a failed write returns its error.
+func (c *Client) BindSync(channelName string, timeout time.Duration) error {
+	return c.writeSync(&Message{Opcode: BindOpcode, ChannelName: channelName, Uuid: newUUID()}, timeout)
+}
+
+//UnbindSync is like Unbind, but waits for the server to accept the unbind.
+func (c *Client) UnbindSync(channelName string, timeout time.Duration) error {
+	return c.writeSync(&Message{Opcode: UnbindOpcode, ChannelName: channelName, Uuid: newUUID()}, timeout)
+}
+
+//WriteSync is like Write, but waits for the server to accept the write.
+//A refused write returns a *ProtocolError, no answer in time returns ErrAckTimeout and a failed write returns its error.
+func (c *Client) WriteSync(channelName string, messageBody []byte, timeout time.Duration) error {
+	return c.writeSync(&Message{Opcode: WriteOpcode, ChannelName: channelName, Uuid: newUUID(), Body: messageBody}, timeout)
+}
+
+//WriteWithHeaders is like Write, but sends headers along with the message body.
+func (c *Client) WriteWithHeaders(channelName string, messageBody []byte, headers map[string]string) {
+	c.send(&Message{Opcode: WriteOpcode, ChannelName: channelName, Uuid: newUUID(), Body: messageBody, Headers: headers})
+}
+
+//QueryPresence asks for the members of a channel with presence.
+//The answer comes in on Read as a PresenceResponseOpcode message, with a list of Members as the body.
+func (c *Client) QueryPresence(channelName string) {
+	c.send(&Message{Opcode: PresenceQueryOpcode, ChannelName: channelName, Uuid: newUUID()})
+}
+
+//WriteDirect sends a message straight to one connection, by its connection ID.
+func (c *Client) WriteDirect(connectionID string, messageBody []byte) {
+	c.send(&Message{Opcode: DirectOpcode, ChannelName: connectionID, Uuid: newUUID(), Body: messageBody})
+}
+
+//WriteToUser sends a message straight to every connection of an identity (like every device a user has open).
+func (c *Client) WriteToUser(identity string, messageBody []byte) {
+	c.send(&Message{Opcode: DirectOpcode, Flags: FlagDirectToIdentity, ChannelName: identity, Uuid: newUUID(), Body: messageBody})
 }
 
 //ServerMessage sends a message to the server for server operations (like getting message history or something)
 func (c *Client) ServerMessage(messageBody []byte) {
-	c.write(&Message{Opcode: ServerOpcode, ChannelName: "", Uuid: newUUID(), Body: messageBody})
+	c.send(&Message{Opcode: ServerOpcode, ChannelName: "", Uuid: newUUID(), Body: messageBody})
+}
+
+//ServerMessageWithHeaders is like ServerMessage, but sends headers along with the message body.
+func (c *Client) ServerMessageWithHeaders(messageBody []byte, headers map[string]string) {
+	c.send(&Message{Opcode: ServerOpcode, ChannelName: "", Uuid: newUUID(), Body: messageBody, Headers: headers})
 }
 
 //WriteStream is to write an whole file to the stream. It chucks the data using the special stream op codes.
 func (c *Client) WriteStream(channelName string, reader io.Reader) error {
 	buf := make([]byte, 32*1024)
-	c.write(&Message{Opcode: StreamStartOpcode, ChannelName: channelName, Uuid: newUUID()})
-	defer c.write(&Message{Opcode: StreamEndOpcode, ChannelName: channelName, Uuid: newUUID()})
+	c.send(&Message{Opcode: StreamStartOpcode, ChannelName: channelName, Uuid: newUUID()})
+	defer c.send(&Message{Opcode: StreamEndOpcode, ChannelName: channelName, Uuid: newUUID()})
 	for {
 		nr, err := reader.Read(buf)
 		if nr > 0 {
-			c.write(&Message{Opcode: StreamWriteOpcode, ChannelName: channelName, Uuid: newUUID(), Body: buf[0:nr]})
+			c.send(&Message{Opcode: StreamWriteOpcode, ChannelName: channelName, Uuid: newUUID(), Body: buf[0:nr]})
 		}
 		if err == io.EOF {
 			return nil
@@ -106,25 +297,63 @@ func (c *Client) WriteStream(channelName string, reader io.Reader) error {
 	}
 }
 
-func (c *Client) write(message *Message) {
-	buf, err := message.Marshal()
-	if err != nil {
-		log.Fatal(err)
+// writeSync asks the server to ack the message and waits for the answer.
+func (c *Client) writeSync(message *Message, timeout time.Duration) error {
+	message.Flags |= FlagAckRequested
+	answer := make(chan *Message, 1)
+	c.pendingMu.Lock()
+	c.pending[message.Uuid] = answer
+	c.pendingMu.Unlock()
+	defer func() {
+		c.pendingMu.Lock()
+		delete(c.pending, message.Uuid)
+		c.pendingMu.Unlock()
+	}()
+
+	if err := c.write(message); err != nil {
+		return err
 	}
-	if err := c.ws.WriteMessage(websocket.BinaryMessage, buf); err != nil {
-		log.Fatal(err) // do something else here.
+	timer := time.NewTimer(timeout)
+	defer timer.Stop()
+	select {
+	case m := <-answer:
+		if m.Opcode == AckOpcode {
+			return nil
+		}
+		return ParseProtocolError(m)
+	case <-timer.C:
+		return ErrAckTimeout
 	}
-
 }
 
-func (c *Client) decodeMessage() *Message {
-	_, buf, err := c.ws.ReadMessage()
-	if err != nil {
-		// handle error
+// answerPending hands an ack, nack or error to the Sync call waiting on it.
+func (c *Client) answerPending(message *Message) bool {
+	switch message.Opcode {
+	case AckOpcode, NackOpcode, ErrorOpcode:
+	default:
+		return false
 	}
-	message, err := Unmarshal(buf)
-	if err != nil {
-		// handle error
+	c.pendingMu.Lock()
+	answer, ok := c.pending[message.Uuid]
+	c.pendingMu.Unlock()
+	if ok {
+		answer <- message
+	}
+	return ok
+}
+
+// send writes a message for the methods that have no error to return.
+func (c *Client) send(message *Message) {
+	if err := c.write(message); err != nil {
+		log.Fatal(err) // do something else here.
 	}
-	return message
+}
+
+// write encodes the message and writes it to the server.
+func (c *Client) write(message *Message) error {
+	c.writeMu.Lock()
+	defer c.writeMu.Unlock()
+	return marshalPooled(c.codec, message, func(buf []byte) error {
+		return c.conn.writeMessage(c.codec, buf)
+	})
 }
@@ -0,0 +1,34 @@
+package conductor
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+// TestSyncReturnsWriteError checks the Sync calls return the error of a write that failed, instead of exiting.
+func TestSyncReturnsWriteError(t *testing.T) {
+	s := New(0, nil, NewSimpleAuth(), nil, nil, nil)
+	s.Start(false)
+	ts := httptest.NewServer(http.HandlerFunc(s.WebsocketHandler))
+	defer ts.Close()
+	c, err := NewClient("ws" + strings.TrimPrefix(ts.URL, "http"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := c.BindSync("chat", time.Second); err != nil {
+		t.Fatal(err)
+	}
+	c.conn.close()
+	if err := c.WriteSync("chat", []byte("hi"), time.Second); err == nil || err == ErrAckTimeout {
+		t.Fatalf("write on a closed connection: %v", err)
+	}
+	if err := c.BindSync("other", time.Second); err == nil || err == ErrAckTimeout {
+		t.Fatalf("bind on a closed connection: %v", err)
+	}
+	if err := c.UnbindSync("chat", time.Second); err == nil || err == ErrAckTimeout {
+		t.Fatalf("unbind on a closed connection: %v", err)
+	}
+}
@@ -0,0 +1,166 @@
+package conductor
+
+import (
+	"encoding/json"
+
+	"github.com/gorilla/websocket"
+)
+
+// Codec is the based interface for encoding messages onto the wire.
+// A codec is picked for each connection through the websocket subprotocol the peer offers.
+type Codec interface {
+	Name() string                             // Name is the websocket subprotocol that selects this codec.
+	FrameType() int                           // FrameType is the websocket frame type to send, like websocket.BinaryMessage or websocket.TextMessage.
+	Marshal(message *Message) ([]byte, error) // Marshal converts a message into bytes for the wire.
+	Unmarshal(b []byte) (*Message, error)     // Unmarshal converts bytes from the wire into a message.
+}
+
+// LimitedCodec is implemented by codecs that check the DecodeLimits while decoding,
+// so connections can decode with limits other than the DefaultDecodeLimits.
+type LimitedCodec interface {
+	UnmarshalLimits(b []byte, limits DecodeLimits) (*Message, error)
+}
+
+// unmarshalLimits decodes the frame with the codec and makes sure it is within the limits.
+func unmarshalLimits(codec Codec, b []byte, limits DecodeLimits) (*Message, error) {
+	if c, ok := codec.(LimitedCodec); ok {
+		return c.UnmarshalLimits(b, limits)
+	}
+	message, err := codec.Unmarshal(b)
+	if err != nil {
+		return nil, err
+	}
+	if err := limits.Check(message); err != nil {
+		return nil, err
+	}
+	return message, nil
+}
+
+// codecs are the codecs a server will negotiate, in order of preference.
+var codecs = []Codec{&BinaryCodec{}, &JSONCodec{}, &MsgPackCodec{}, &ProtobufCodec{}}
+
+// RegisterCodec adds a codec that servers can negotiate with their peers.
+// A codec with the same name as one already registered replaces it.
+// This isn't safe to call once servers are running, so do it during setup.
+func RegisterCodec(codec Codec) {
+	for i, c := range codecs {
+		if c.Name() == codec.Name() {
+			codecs[i] = codec
+			return
+		}
+	}
+	codecs = append(codecs, codec)
+}
+
+// codecNames returns the names of the registered codecs for the upgrader's subprotocol list.
+func codecNames() []string {
+	names := make([]string, 0, len(codecs))
+	for _, c := range codecs {
+		names = append(names, c.Name())
+	}
+	return names
+}
+
+// negotiatedCodec returns the codec that matches the subprotocol agreed on during the websocket handshake.
+// Peers that didn't agree on any subprotocol predate codecs and get legacy frames.
+func negotiatedCodec(ws *websocket.Conn) Codec {
+	subprotocol := ws.Subprotocol()
+	for _, c := range codecs {
+		if c.Name() == subprotocol {
+			return c
+		}
+	}
+	return &legacyCodec{}
+}
+
+// BinaryCodec is the default codec. It writes the versioned little-endian frame from Message.Marshal.
+type BinaryCodec struct {
+}
+
+// Name returns the subprotocol of versioned binary frames.
+func (c *BinaryCodec) Name() string {
+	return frameSubprotocol
+}
+
+// FrameType sends binary frames.
+func (c *BinaryCodec) FrameType() int {
+	return websocket.BinaryMessage
+}
+
+// Marshal writes the current frame version.
+func (c *BinaryCodec) Marshal(message *Message) ([]byte, error) {
+	return message.Marshal()
+}
+
+// AppendMarshal appends the current frame version to dst.
+func (c *BinaryCodec) AppendMarshal(dst []byte, message *Message) ([]byte, error) {
+	return message.AppendMarshal(dst)
+}
+
+// Unmarshal reads either a legacy or a versioned frame.
+func (c *BinaryCodec) Unmarshal(b []byte) (*Message, error) {
+	return Unmarshal(b)
+}
+
+// UnmarshalLimits is like Unmarshal, but checks the fields against the limits provided.
+func (c *BinaryCodec) UnmarshalLimits(b []byte, limits DecodeLimits) (*Message, error) {
+	return UnmarshalLimits(b, limits)
+}
+
+// JSONCodec sends each message as a JSON text frame, using the struct tags on Message.
+// This is handy for browsers and debugging, since no custom framing needs to be ported.
+type JSONCodec struct {
+}
+
+// Name returns the subprotocol of JSON text frames.
+func (c *JSONCodec) Name() string {
+	return "conductor.json"
+}
+
+// FrameType sends text frames.
+func (c *JSONCodec) FrameType() int {
+	return websocket.TextMessage
+}
+
+// Marshal encodes the message as JSON.
+func (c *JSONCodec) Marshal(message *Message) ([]byte, error) {
+	return json.Marshal(message)
+}
+
+// Unmarshal decodes a JSON message.
+func (c *JSONCodec) Unmarshal(b []byte) (*Message, error) {
+	var m Message
+	if err := json.Unmarshal(b, &m); err != nil {
+		return nil, err
+	}
+	return &m, nil
+}
+
+// legacyCodec is used for peers that predate versioned frames.
+// It can read either layout, but only writes the legacy one.
+type legacyCodec struct {
+}
+
+func (c *legacyCodec) Name() string {
+	return ""
+}
+
+func (c *legacyCodec) FrameType() int {
+	return websocket.BinaryMessage
+}
+
+func (c *legacyCodec) Marshal(message *Message) ([]byte, error) {
+	return message.MarshalVersion(LegacyFrameVersion)
+}
+
+func (c *legacyCodec) AppendMarshal(dst []byte, message *Message) ([]byte, error) {
+	return message.AppendMarshalVersion(dst, LegacyFrameVersion)
+}
+
+func (c *legacyCodec) Unmarshal(b []byte) (*Message, error) {
+	return Unmarshal(b)
+}
+
+func (c *legacyCodec) UnmarshalLimits(b []byte, limits DecodeLimits) (*Message, error) {
+	return UnmarshalLimits(b, limits)
+}
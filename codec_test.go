@@ -0,0 +1,44 @@
+package conductor
+
+import (
+	"errors"
+	"testing"
+
+	"google.golang.org/protobuf/encoding/protowire"
+)
+
+// TestReservedExtensionsRejected checks the codecs refuse an extension whose type maps to a field of Message,
+// since no codec could write the message back out.
+func TestReservedExtensionsRejected(t *testing.T) {
+	for _, extType := range []uint16{ExtensionHeaders, ExtensionSender, ExtensionSequence, ExtensionTimestamp} {
+		message := &Message{Opcode: WriteOpcode, Uuid: "u", ChannelName: "c", Extensions: []Extension{{Type: extType}}}
+		for _, codec := range []Codec{&JSONCodec{}, &MsgPackCodec{}} {
+			message.Extensions[0].Type = 0x9000
+			b, err := codec.Marshal(message)
+			if err != nil {
+				t.Fatal(err)
+			}
+			message.Extensions[0].Type = extType
+			reserved, err := codec.Marshal(message)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if _, err := unmarshalLimits(codec, b, DefaultDecodeLimits); err != nil {
+				t.Fatalf("%s: unreserved extension: %v", codec.Name(), err)
+			}
+			if _, err := unmarshalLimits(codec, reserved, DefaultDecodeLimits); !errors.Is(err, ErrFieldExtension) {
+				t.Fatalf("%s: extension type %d: %v", codec.Name(), extType, err)
+			}
+		}
+
+		ext := protowire.AppendTag(nil, protoExtensionValue, protowire.BytesType)
+		ext = protowire.AppendBytes(ext, []byte("x"))
+		ext = protowire.AppendTag(ext, protoExtensionType, protowire.VarintType)
+		ext = protowire.AppendVarint(ext, uint64(extType))
+		b := protowire.AppendTag(nil, protoExtensions, protowire.BytesType)
+		b = protowire.AppendBytes(b, ext)
+		if _, err := (&ProtobufCodec{}).Unmarshal(b); !errors.Is(err, ErrFieldExtension) {
+			t.Fatalf("protobuf: extension type %d: %v", extType, err)
+		}
+	}
+}
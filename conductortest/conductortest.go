@@ -0,0 +1,200 @@
+// Package conductortest runs a conductor hub in memory, for testing plugins like a ServerHubHandler or ConnectionAuth
+// without a server, a port or sleeps.
+//
+// Clients are MemoryConnections. Every call that sends a message waits for the hub to process it,
+// so by the time it returns, whatever the hub delivered is already in the inboxes of the clients.
+//
+//	h := conductortest.New(conductortest.Options{Auth: conductor.NewSimpleAuth()})
+//	defer h.Close()
+//	alice, bob := h.Connect(t, nil), h.Connect(t, nil)
+//	alice.Bind("chat")
+//	bob.Write("chat", []byte("hi"))
+//	alice.ExpectMessage(t, conductor.WriteOpcode, "chat")
+package conductortest
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/Vluxe/conductor"
+)
+
+// ErrNotAuthorized is returned by Dial when the ConnectionAuth turns the request down.
+var ErrNotAuthorized = errors.New("conductortest: not authorized")
+
+// Options are the plugins of the hub. They can all be nil.
+type Options struct {
+	Deduper       conductor.DeDuplication
+	Auth          conductor.ConnectionAuth
+	Storage       conductor.Storage
+	ServerHandler conductor.ServerHubHandler
+	SisterManager conductor.SisterManager
+
+	// Setup is called with the hub before it starts, to set the things that have to be set before then,
+	// like the validator, presence, channel policies or middleware.
+	Setup func(hub *conductor.MultiPlexHub)
+}
+
+// Harness is a running hub and the clients connected to it.
+type Harness struct {
+	Hub *conductor.MultiPlexHub
+}
+
+// New creates a hub with the plugins in the options and starts it.
+func New(options Options) *Harness {
+	hub := conductor.NewMultiPlexHub(options.Deduper, options.Auth, options.Storage, options.ServerHandler, options.SisterManager)
+	if options.Setup != nil {
+		options.Setup(hub)
+	}
+	go hub.RunLoop()
+	return &Harness{Hub: hub}
+}
+
+// Close shuts the hub down, which stops the deduper and flushes the storage like it does for a Server.
+func (h *Harness) Close() error {
+	return h.Hub.Shutdown(context.Background())
+}
+
+// Sync waits for the hub to process every message sent so far. The Client methods call it for you.
+// It goes straight to the shards, so the validator and the middleware never see it.
+func (h *Harness) Sync() {
+	h.Hub.Sync()
+}
+
+// Dial connects a client the way the server connects a websocket: the request goes through IsValid and ConnToRequest,
+// then the client is added to the registry. A nil request is a plain GET of /. It returns ErrNotAuthorized if
+// IsValid turns the request down.
+func (h *Harness) Dial(r *http.Request) (*Client, error) {
+	if r == nil {
+		r = httptest.NewRequest("GET", "/", nil)
+	}
+	auth := h.Hub.Auth()
+	if auth != nil && !auth.IsValid(r) {
+		return nil, ErrNotAuthorized
+	}
+	conn := conductor.NewMemoryConnection(h.Hub)
+	if auth != nil {
+		auth.ConnToRequest(r, conn)
+	}
+	h.Hub.Connected(conn)
+	return &Client{Conn: conn, h: h}, nil
+}
+
+// Connect is like Dial, but fails the test if the client can't connect.
+func (h *Harness) Connect(t testing.TB, r *http.Request) *Client {
+	t.Helper()
+	c, err := h.Dial(r)
+	if err != nil {
+		t.Fatalf("conductortest: connect: %v", err)
+	}
+	return c
+}
+
+// Client is a client connected to the hub of a Harness.
+// The messages the hub delivers to it wait in its inbox until they are taken with Messages or one of the Expect methods.
+type Client struct {
+	Conn *conductor.MemoryConnection // Conn is the connection the hub sees, for its ID and local storage.
+	h    *Harness
+
+	// messages taken from the connection's inbox but not handed out yet.
+	received []*conductor.Message
+}
+
+// Send hands the message to the hub and waits for the hub to process it. A message without a Uuid gets one.
+// If the hub answered the message with an ack, a nack or an error, the answer is taken out of the inbox,
+// and a nack or an error is returned as a *conductor.ProtocolError.
+func (c *Client) Send(message *conductor.Message) error {
+	c.Conn.Send(message)
+	c.h.Sync()
+	c.collect()
+	for i, m := range c.received {
+		if m.Uuid != message.Uuid {
+			continue
+		}
+		switch m.Opcode {
+		case conductor.AckOpcode:
+		case conductor.NackOpcode, conductor.ErrorOpcode:
+		default:
+			continue
+		}
+		c.received = append(c.received[:i:i], c.received[i+1:]...)
+		if m.Opcode == conductor.AckOpcode {
+			return nil
+		}
+		return conductor.ParseProtocolError(m)
+	}
+	return nil
+}
+
+// ID returns the ID of the client's connection.
+func (c *Client) ID() string {
+	return c.Conn.ID()
+}
+
+// Bind binds the client to the channel, returning the *conductor.ProtocolError if the hub refused.
+func (c *Client) Bind(channelName string) error {
+	return c.Send(&conductor.Message{Opcode: conductor.BindOpcode, Flags: conductor.FlagAckRequested, ChannelName: channelName})
+}
+
+// Unbind unbinds the client from the channel, returning the *conductor.ProtocolError if the hub refused.
+func (c *Client) Unbind(channelName string) error {
+	return c.Send(&conductor.Message{Opcode: conductor.UnbindOpcode, Flags: conductor.FlagAckRequested, ChannelName: channelName})
+}
+
+// Write writes the body to the channel, returning the *conductor.ProtocolError if the hub refused.
+func (c *Client) Write(channelName string, body []byte) error {
+	return c.Send(&conductor.Message{Opcode: conductor.WriteOpcode, Flags: conductor.FlagAckRequested, ChannelName: channelName, Body: body})
+}
+
+// ServerMessage sends the body to the ServerHubHandler.
+func (c *Client) ServerMessage(body []byte) error {
+	return c.Send(&conductor.Message{Opcode: conductor.ServerOpcode, Body: body})
+}
+
+// Close disconnects the client, waits for the hub to clean up after it and removes it from the registry.
+func (c *Client) Close() {
+	c.Conn.Disconnect()
+	c.h.Sync()
+	c.h.Hub.Disconnected(c.Conn)
+}
+
+// Messages takes every message the hub delivered to the client, oldest first.
+func (c *Client) Messages() []*conductor.Message {
+	c.collect()
+	messages := c.received
+	c.received = nil
+	return messages
+}
+
+// ExpectMessage takes the oldest delivered message with the opcode on the channel, failing the test if there is none.
+// The messages before it stay in the inbox.
+func (c *Client) ExpectMessage(t testing.TB, opcode uint16, channelName string) *conductor.Message {
+	t.Helper()
+	c.collect()
+	for i, m := range c.received {
+		if m.Opcode == opcode && m.ChannelName == channelName {
+			c.received = append(c.received[:i:i], c.received[i+1:]...)
+			return m
+		}
+	}
+	t.Fatalf("conductortest: no message with opcode %d on %q in %d delivered", opcode, channelName, len(c.received))
+	return nil
+}
+
+// ExpectNothing fails the test if the hub delivered anything to the client that hasn't been taken yet.
+func (c *Client) ExpectNothing(t testing.TB) {
+	t.Helper()
+	c.collect()
+	if len(c.received) > 0 {
+		m := c.received[0]
+		t.Fatalf("conductortest: expected nothing, but %d delivered (first is opcode %d on %q)", len(c.received), m.Opcode, m.ChannelName)
+	}
+}
+
+// collect moves the messages in the connection's inbox to received.
+func (c *Client) collect() {
+	c.received = append(c.received, c.Conn.Messages()...)
+}
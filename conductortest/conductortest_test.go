@@ -0,0 +1,191 @@
+package conductortest_test
+
+import (
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/Vluxe/conductor"
+	"github.com/Vluxe/conductor/conductortest"
+)
+
+// userAuth lets in requests with a ?user= and uses it as the identity of the connection.
+type userAuth struct {
+	conductor.SimpleAuth
+}
+
+func (a *userAuth) IsValid(r *http.Request) bool {
+	return r.URL.Query().Get("user") != ""
+}
+
+func (a *userAuth) ConnToRequest(r *http.Request, conn conductor.Connection) {
+	conn.Store(conductor.IdentityKey, r.URL.Query().Get("user"))
+}
+
+// echoHandler answers server messages with their body.
+type echoHandler struct{}
+
+func (echoHandler) Process(conn conductor.Connection, message *conductor.Message) {
+	conn.Write(&conductor.Message{Opcode: conductor.ServerOpcode, Uuid: message.Uuid, Body: append([]byte("re:"), message.Body...)})
+}
+
+func request(user string) *http.Request {
+	return httptest.NewRequest("GET", "/?user="+user, nil)
+}
+
+func TestHarness(t *testing.T) {
+	h := conductortest.New(conductortest.Options{
+		Deduper:       conductor.NewDeDuper(time.Second, time.Second),
+		Auth:          &userAuth{},
+		ServerHandler: echoHandler{},
+		Setup: func(hub *conductor.MultiPlexHub) {
+			hub.SetPresence(func(channelName string) bool { return channelName == "chat" })
+		},
+	})
+	if _, err := h.Dial(nil); err != conductortest.ErrNotAuthorized {
+		t.Fatalf("dial without a user: %v", err)
+	}
+	alice := h.Connect(t, request("alice"))
+	bob := h.Connect(t, request("bob"))
+
+	// Send takes the acks out of the inbox, so there is nothing left after a bind.
+	if err := alice.Bind("chat"); err != nil {
+		t.Fatal(err)
+	}
+	alice.ExpectNothing(t)
+	if err := bob.Bind("chat"); err != nil {
+		t.Fatal(err)
+	}
+	alice.ExpectMessage(t, conductor.JoinOpcode, "chat")
+	bob.ExpectNothing(t)
+
+	if err := bob.Write("chat", []byte("hi")); err != nil {
+		t.Fatal(err)
+	}
+	m := alice.ExpectMessage(t, conductor.WriteOpcode, "chat")
+	if string(m.Body) != "hi" || m.Sender != "bob" {
+		t.Fatalf("got %q from %q", m.Body, m.Sender)
+	}
+	alice.ExpectNothing(t)
+	bob.ExpectNothing(t)
+
+	// a nack comes back as the ProtocolError, and is taken out of the inbox too.
+	var perr *conductor.ProtocolError
+	if err := bob.Write("other", nil); !errors.As(err, &perr) || perr.Code != conductor.ErrCodeUnauthorized {
+		t.Fatalf("write to an unbound channel: %v", err)
+	}
+	bob.ExpectNothing(t)
+
+	if err := bob.ServerMessage([]byte("x")); err != nil {
+		t.Fatal(err)
+	}
+	if m := bob.ExpectMessage(t, conductor.ServerOpcode, ""); string(m.Body) != "re:x" {
+		t.Fatalf("server answered %q", m.Body)
+	}
+
+	if err := bob.Unbind("chat"); err != nil {
+		t.Fatal(err)
+	}
+	alice.ExpectMessage(t, conductor.LeaveOpcode, "chat")
+	bob.Bind("chat")
+	alice.ExpectMessage(t, conductor.JoinOpcode, "chat")
+
+	if h.Hub.Lookup(bob.ID()) == nil {
+		t.Fatal("bob isn't in the registry")
+	}
+	bob.Close()
+	alice.ExpectMessage(t, conductor.LeaveOpcode, "chat")
+	if h.Hub.Lookup(bob.ID()) != nil {
+		t.Fatal("bob is still in the registry after Close")
+	}
+	alice.ExpectNothing(t)
+
+	if err := h.Close(); err != nil {
+		t.Fatal(err)
+	}
+	h.Sync() // returns once the hub is shut down instead of waiting forever.
+}
+
+func TestExpectMessageKeepsEarlierMessages(t *testing.T) {
+	h := conductortest.New(conductortest.Options{Auth: conductor.NewSimpleAuth()})
+	defer h.Close()
+	alice, bob := h.Connect(t, nil), h.Connect(t, nil)
+	for _, channelName := range []string{"a", "b"} {
+		if err := alice.Bind(channelName); err != nil {
+			t.Fatal(err)
+		}
+		if err := bob.Bind(channelName); err != nil {
+			t.Fatal(err)
+		}
+	}
+	bob.Write("a", []byte("1"))
+	bob.Write("b", []byte("2"))
+	if m := alice.ExpectMessage(t, conductor.WriteOpcode, "b"); string(m.Body) != "2" {
+		t.Fatalf("got %q on b", m.Body)
+	}
+	messages := alice.Messages()
+	if len(messages) != 1 || string(messages[0].Body) != "1" {
+		t.Fatalf("%d messages left", len(messages))
+	}
+	alice.ExpectNothing(t)
+}
+
+// TestMiddlewareAndValidator checks the messages sent through a harness go through the validator and the middleware,
+// while Sync doesn't, since it is handed straight to the shards.
+func TestMiddlewareAndValidator(t *testing.T) {
+	var seen []uint16
+	h := conductortest.New(conductortest.Options{
+		Auth: conductor.NewSimpleAuth(),
+		Setup: func(hub *conductor.MultiPlexHub) {
+			hub.SetValidator(conductor.NewStandardValidator())
+			hub.Use(func(next conductor.HandlerFunc) conductor.HandlerFunc {
+				return func(conn conductor.Connection, message *conductor.Message, fromSister bool) {
+					seen = append(seen, message.Opcode)
+					next(conn, message, fromSister)
+				}
+			})
+		},
+	})
+	defer h.Close()
+	c := h.Connect(t, nil)
+
+	var perr *conductor.ProtocolError
+	if err := c.Write("", []byte("x")); !errors.As(err, &perr) {
+		t.Fatalf("write without a channel: %v", err)
+	}
+	if len(seen) != 0 {
+		t.Fatalf("middleware saw the invalid message (%v)", seen)
+	}
+	if err := c.Bind("chat"); err != nil {
+		t.Fatal(err)
+	}
+	if err := c.Write("chat", []byte("x")); err != nil {
+		t.Fatal(err)
+	}
+	h.Sync()
+	if len(seen) != 2 || seen[0] != conductor.BindOpcode || seen[1] != conductor.WriteOpcode {
+		t.Fatalf("middleware saw %v", seen)
+	}
+	c.ExpectNothing(t)
+}
+
+// TestRetryIsNotAcked checks a message sent again with the same Uuid is nacked as a duplicate,
+// instead of being acked no matter how the first one went.
+func TestRetryIsNotAcked(t *testing.T) {
+	h := conductortest.New(conductortest.Options{Deduper: conductor.NewDeDuper(time.Second, time.Second), Auth: conductor.NewSimpleAuth()})
+	defer h.Close()
+	c := h.Connect(t, nil)
+
+	write := &conductor.Message{Opcode: conductor.WriteOpcode, Flags: conductor.FlagAckRequested, ChannelName: "chat", Uuid: "3f2b8c9e-4d1a-4c7b-9e2f-1a2b3c4d5e6f"}
+	var perr *conductor.ProtocolError
+	if err := c.Send(write); !errors.As(err, &perr) || perr.Code != conductor.ErrCodeUnauthorized {
+		t.Fatalf("write to an unbound channel: %v", err)
+	}
+	retry := *write
+	if err := c.Send(&retry); !errors.As(err, &perr) || perr.Code != conductor.ErrCodeDuplicate {
+		t.Fatalf("retry: %v", err)
+	}
+	c.ExpectNothing(t)
+}
@@ -1,35 +1,169 @@
 package conductor
 
 import (
+	"errors"
+	"sync"
 	"time"
 
 	"github.com/gorilla/websocket"
 )
 
 // Connection is the based interface for mocking a connection.
+// The channel list and local storage are used from several goroutines at once, so they have to be safe for concurrent use.
+// Embedding ConnectionState takes care of that.
 type Connection interface {
-	Write(message *Message) error  // Write is to send a message to the client this connection represents.
-	ReadLoop(hub HubConnection)    // ReadLoop is the loop that keeps this connection alive. Don't call this.
-	Disconnect()                   // Disconnect is use to disconnect the connection.
-	Channels() []string            // Channels is to hold the channels this connection is bound to. Very useful for auth and cleanup.
-	SetChannels(channels []string) // Update the channel list of this connection.
-	Store(key, value string)       // Store is a map of local storage for the connection. This way you can identify the connection in other interfaces.
-	Get(key string) string         // Get is a map of local storage for the connection.
+	ID() string                            // ID is the stable ID the server assigned to this connection.
+	Write(message *Message) error          // Write is to send a message to the client this connection represents.
+	ReadLoop(hub HubConnection)            // ReadLoop is the loop that keeps this connection alive. Don't call this.
+	Disconnect()                           // Disconnect is use to disconnect the connection.
+	Channels() []string                    // Channels is a copy of the channels this connection is bound to. Very useful for auth and cleanup.
+	AddChannel(channelName string) bool    // AddChannel adds a channel to the list. It returns false if it was already there.
+	RemoveChannel(channelName string) bool // RemoveChannel removes a channel from the list. It returns false if it wasn't there.
+	HasChannel(channelName string) bool    // HasChannel checks if the connection is bound to the channel.
+	Store(key string, value interface{})   // Store is a map of local storage for the connection. This way you can identify the connection in other interfaces.
+	Get(key string) interface{}            // Get is a map of local storage for the connection. It returns nil for keys that aren't stored.
 }
 
-const (
-	// Time allowed to write a message to the peer.
-	writeWait = 10 * time.Second
+// queuedConnection is the state every network Connection shares: the ID, the hub, the channel list and local storage,
+// the codec and limits, and the outbound queue the connection's writer goroutine drains.
+// Connections embed it and call setup with themselves, so the hub always hears from the Connection it knows about.
+type queuedConnection struct {
+	// the Connection embedding this one.
+	self Connection
 
-	// Time allowed to read the next pong message from the peer.
-	pongWait = 60 * time.Second
+	// the ID the server assigned to this connection.
+	id string
 
-	// Send pings to peer with this period. Must be less than pongWait.
-	pingPeriod = (pongWait * 9) / 10
+	// we might want to change this to a singleton, but maintain a pointer to the hub.
+	h HubConnection
 
-	// Maximum message size allowed from peer.
-	maxMessageSize = 512 * 500 //TODO: Don't leave me like this!!
-)
+	// maintain a list of channels this client is bound to (useful for clean up) and
+	// a map of content for the connection (like an auth token so the connection can be associated to a user).
+	ConnectionState
+
+	// is this a connection used for sister federation between servers?
+	isSister bool
+
+	// the codec the peer negotiated for encoding messages.
+	codec Codec
+
+	// the limits and timeouts of this connection.
+	options ServerOptions
+
+	// the decode limits, which let bodies be as big as the options allow.
+	limits DecodeLimits
+
+	// the messages waiting for the writer goroutine, which is the only thing that writes to the peer.
+	queue *outboundQueue
+
+	// makes sure the hub only hears about the disconnect once.
+	disconnectOnce sync.Once
+}
+
+// setup fills in the shared state of the Connection self, filling in the options that aren't set with the defaults.
+func (c *queuedConnection) setup(self Connection, h HubConnection, isSister bool, codec Codec, options ServerOptions) {
+	options = options.withDefaults()
+	c.self, c.id, c.h, c.isSister, c.codec = self, newUUID(), h, isSister, codec
+	c.options, c.limits = options, options.decodeLimits()
+	policy := options.OverflowPolicy
+	if isSister {
+		policy = options.SisterOverflowPolicy
+	}
+	c.queue = newOutboundQueue(options.QueueSize, policy)
+	c.Store(ConnectionIDKey, c.id)
+}
+
+//ID returns the ID the server assigned to this connection.
+func (c *queuedConnection) ID() string {
+	return c.id
+}
+
+//Write queues the message to be sent to the peer.
+//What happens when the queue is full is up to the OverflowPolicy of the connection.
+func (c *queuedConnection) Write(message *Message) error {
+	return c.queue.push(outbound{message: message})
+}
+
+//WritePrepared queues a message that is encoded once for every connection using the same codec.
+func (c *queuedConnection) WritePrepared(pm *PreparedMessage) error {
+	return c.queue.push(outbound{prepared: pm})
+}
+
+//QueueDepth is how many messages are waiting to be written to the peer.
+func (c *queuedConnection) QueueDepth() int {
+	return c.queue.depth()
+}
+
+//QueueCapacity is how many messages can wait before the OverflowPolicy kicks in.
+func (c *queuedConnection) QueueCapacity() int {
+	return c.queue.capacity()
+}
+
+//QueueDropped is how many messages the OverflowPolicy has thrown away.
+func (c *queuedConnection) QueueDropped() uint64 {
+	return c.queue.droppedCount()
+}
+
+//Disconnect removes the connection from the hub and closes it once the writer is done.
+func (c *queuedConnection) Disconnect() {
+	c.disconnectOnce.Do(func() {
+		c.h.Write(c.self, NewCleanUpMessage())
+		c.queue.close(nil)
+	})
+}
+
+// goAway closes the connection once the queued messages are written, telling the peer the server is going away
+// if the transport has a way to. The read loop then disconnects it from the hub like any other close.
+func (c *queuedConnection) goAway() {
+	c.queue.close(errGoingAway)
+}
+
+// decodeMessage decodes a frame with the negotiated codec and makes sure it is within the decode limits.
+func (c *queuedConnection) decodeMessage(buf []byte) (*Message, error) {
+	return unmarshalLimits(c.codec, buf, c.limits)
+}
+
+// writeEncoded encodes a message from the queue with the codec and hands it to write, which must not hold onto it.
+// If the codec can't encode the message, the peer is written an ErrorOpcode with ErrCodeEncodeFailed in its place.
+func (c *queuedConnection) writeEncoded(out outbound, write func([]byte) error) error {
+	if out.prepared != nil {
+		buf, err := out.prepared.encoding(c.codec)
+		if err != nil {
+			return c.encodeFailed(out, err, write)
+		}
+		return write(buf)
+	}
+	err := marshalPooled(c.codec, out.message, write)
+	var encodeErr *encodeError
+	if errors.As(err, &encodeErr) {
+		return c.encodeFailed(out, encodeErr.err, write)
+	}
+	return err
+}
+
+// encodeFailed writes the peer an ErrorOpcode with ErrCodeEncodeFailed for a message the codec couldn't encode,
+// so the message isn't lost without a trace. If even the error can't be encoded, the error is returned,
+// which drops the connection.
+func (c *queuedConnection) encodeFailed(out outbound, err error, write func([]byte) error) error {
+	message := out.message
+	if out.prepared != nil {
+		message = out.prepared.Message
+	}
+	if message.Opcode == ErrorOpcode {
+		return err
+	}
+	perr := &ProtocolError{Code: ErrCodeEncodeFailed, Reason: err.Error()}
+	return c.writeEncoded(outbound{message: perr.errorMessage(message)}, write)
+}
+
+// forward hands a message read off the connection to the hub.
+func (c *queuedConnection) forward(hub HubConnection, message *Message) {
+	if c.isSister {
+		hub.ReceivedSisterMessage(c.self, message)
+	} else {
+		hub.Write(c.self, message)
+	}
+}
 
 //WSConnection is the default websocket implementation.
 type wsconnection struct {
@@ -39,106 +173,113 @@ type wsconnection struct {
 	// hold onto the ticker so we can clean it up later
 	ticker *time.Ticker
 
-	// we might want to change this to a singleton, but maintain a pointer to the hub.
-	h HubConnection
-
-	// maintain a list of channels this client is bound to. (useful for clean up.)
-	channels []string
-
-	// maintain a map of content for the connection (like an auth token so the connection can be associated to a user).
-	storage map[string]string
-
-	// is this a connection used for sister federation between servers?
-	isSister bool
+	// the ID, hub, channels, codec, limits and outbound queue.
+	queuedConnection
 }
 
 // newWSConnection creates a new wsconnection object using the gorilla websocket.Conn as the underlying transport.
 // HubConnection is also provided to have a simple way to write to the hub without having the hubs runloop methods.
-func newWSConnection(ws *websocket.Conn, h HubConnection, isSister bool) *wsconnection {
-	return &wsconnection{ws: ws, h: h, channels: make([]string, 1), ticker: time.NewTicker(pingPeriod),
-		isSister: isSister, storage: make(map[string]string)}
+// options are the limits and timeouts of the connection.
+func newWSConnection(ws *websocket.Conn, h HubConnection, isSister bool, options ServerOptions) *wsconnection {
+	c := &wsconnection{ws: ws}
+	c.setup(c, h, isSister, negotiatedCodec(ws), options)
+	c.ticker = time.NewTicker(c.options.PingPeriod)
+	return c
 }
 
 // ReadLoop sets up the websocket reader in a loop to handle messages and forward them to the hub as they come in
-// It also starts the ticker to ensure the socket has stimulation and doesn't get closed as an idle connection.
+// It also starts the writer goroutine, which drains the outbound queue and pings to ensure the socket has
+// stimulation and doesn't get closed as an idle connection.
 func (c *wsconnection) ReadLoop(hub HubConnection) {
-	// Setup our connection's websocket ping/pong handlers from our const values.
-	c.ws.SetReadLimit(maxMessageSize)
-	c.ws.SetReadDeadline(time.Now().Add(pongWait))
-	c.ws.SetPongHandler(func(string) error { c.ws.SetReadDeadline(time.Now().Add(pongWait)); return nil })
+	// Setup our connection's websocket ping/pong handlers from our options.
+	c.ws.SetReadLimit(c.options.MaxMessageSize)
+	c.ws.SetReadDeadline(time.Now().Add(c.options.PongWait))
+	c.ws.SetPongHandler(func(string) error { c.ws.SetReadDeadline(time.Now().Add(c.options.PongWait)); return nil })
 
-	go c.doTick() // keeps the websocket simulated as per spec.
+	go c.writeLoop() // keeps the websocket simulated as per spec.
 
 	for {
-		mess := c.decodeMessage()
-		if mess == nil {
+		_, buf, err := c.ws.ReadMessage()
+		if err != nil {
 			c.Disconnect()
 			break
-		} else {
-			if c.isSister {
-				hub.ReceivedSisterMessage(c, mess)
-			} else {
-				hub.Write(c, mess)
-			}
 		}
+		mess, err := c.decodeMessage(buf)
+		if err != nil {
+			continue // drop the frame instead of handing a half decoded message to the hub.
+		}
+		c.forward(hub, mess)
 	}
 }
 
-//Store puts something into the local storage of this connection.
-func (c *wsconnection) Store(key, value string) {
-	c.storage[key] = value
-}
-
-//Gets get the value out local storage of this connection.
-func (c *wsconnection) Get(key string) string {
-	return c.storage[key]
-}
-
-//Write sends the content of the message to the client.
-func (c *wsconnection) Write(message *Message) error {
-	buf, err := message.Marshal()
-	if err != nil {
-		return err
-	}
-	return c.ws.WriteMessage(websocket.BinaryMessage, buf)
-}
-
-func (c *wsconnection) doTick() {
-	defer func() {
-		c.Disconnect()
-	}()
+// writeLoop is the only thing that writes to the websocket. It drains the queue and pings the peer.
+// If a write fails the websocket is closed, which ends the read loop and disconnects the connection.
+func (c *wsconnection) writeLoop() {
+	defer c.ticker.Stop()
 
 	for { // blocking loop with select to wait for stimulation.
 		select {
+		case out := <-c.queue.messages:
+			if err := c.writeOutbound(out); err != nil {
+				c.ws.Close()
+				return
+			}
 		case <-c.ticker.C:
-			c.ws.WriteMessage(websocket.PingMessage, nil)
+			c.ws.SetWriteDeadline(time.Now().Add(c.options.WriteWait))
+			if err := c.ws.WriteMessage(websocket.PingMessage, nil); err != nil {
+				c.ws.Close()
+				return
+			}
+		case <-c.queue.done:
+			c.flush()
+			c.writeClose()
+			return
 		}
 	}
 }
 
-func (c *wsconnection) Disconnect() {
-	c.ticker.Stop()
-	c.h.Write(c, &Message{Opcode: CleanUpOpcode, ChannelName: ""})
-	c.ws.WriteMessage(websocket.CloseMessage, nil)
-	c.ws.Close()
-}
-
-func (c *wsconnection) Channels() []string {
-	return c.channels
+// writeOutbound writes a message from the queue, giving up after the WriteWait.
+func (c *wsconnection) writeOutbound(out outbound) error {
+	c.ws.SetWriteDeadline(time.Now().Add(c.options.WriteWait))
+	write := func(buf []byte) error {
+		return c.ws.WriteMessage(c.codec.FrameType(), buf)
+	}
+	if out.prepared != nil {
+		frame, err := out.prepared.websocketFrame(c.codec)
+		if err != nil {
+			return c.encodeFailed(out, err, write)
+		}
+		return c.ws.WritePreparedMessage(frame)
+	}
+	return c.writeEncoded(out, write)
 }
 
-func (c *wsconnection) SetChannels(channels []string) {
-	c.channels = channels
+// flush writes what is left in the queue, unless the connection is being dropped for being too slow.
+func (c *wsconnection) flush() {
+	if c.queue.closeReason() == ErrSlowConsumer {
+		return
+	}
+	for {
+		select {
+		case out := <-c.queue.messages:
+			if err := c.writeOutbound(out); err != nil {
+				return
+			}
+		default:
+			return
+		}
+	}
 }
 
-func (c *wsconnection) decodeMessage() *Message {
-	_, buf, err := c.ws.ReadMessage()
-	if err != nil {
-		//TODO: handle error
+// writeClose sends the close frame, saying why the connection is going away, and closes the websocket.
+func (c *wsconnection) writeClose() {
+	code, text := websocket.CloseNormalClosure, ""
+	switch c.queue.closeReason() {
+	case ErrSlowConsumer:
+		code, text = websocket.ClosePolicyViolation, "slow consumer"
+	case errGoingAway:
+		code, text = websocket.CloseGoingAway, "server shutting down"
 	}
-	message, err := Unmarshal(buf)
-	if err != nil {
-		//TODO: handle error
-	}
-	return message
+	c.ws.WriteControl(websocket.CloseMessage, websocket.FormatCloseMessage(code, text), time.Now().Add(c.options.WriteWait))
+	c.ws.Close()
 }
@@ -0,0 +1,81 @@
+package conductor
+
+import "sync"
+
+// ConnectionState is the channel list and local storage of a connection. It is safe for concurrent use,
+// since the hub's shards, the read loop and the plugins all use it at once.
+// Embed it in a Connection implementation to get Channels, AddChannel, RemoveChannel, HasChannel, Store and Get.
+// The zero value is ready to use.
+type ConnectionState struct {
+	mu       sync.RWMutex
+	channels []string
+	storage  map[string]interface{}
+}
+
+// Channels returns a copy of the channels (and patterns) the connection is bound to.
+func (s *ConnectionState) Channels() []string {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	return append([]string(nil), s.channels...)
+}
+
+// AddChannel adds the channel to the list. It returns false if the channel was already in it.
+func (s *ConnectionState) AddChannel(channelName string) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for _, channel := range s.channels {
+		if channel == channelName {
+			return false
+		}
+	}
+	s.channels = append(s.channels, channelName)
+	return true
+}
+
+// RemoveChannel removes the channel from the list. It returns false if the channel wasn't in it.
+func (s *ConnectionState) RemoveChannel(channelName string) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for i, channel := range s.channels {
+		if channel == channelName {
+			s.channels = append(s.channels[:i], s.channels[i+1:]...)
+			return true
+		}
+	}
+	return false
+}
+
+// HasChannel checks if the channel is in the list.
+func (s *ConnectionState) HasChannel(channelName string) bool {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	for _, channel := range s.channels {
+		if channel == channelName {
+			return true
+		}
+	}
+	return false
+}
+
+// Store puts the value in the local storage under the key.
+func (s *ConnectionState) Store(key string, value interface{}) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.storage == nil {
+		s.storage = make(map[string]interface{})
+	}
+	s.storage[key] = value
+}
+
+// Get returns the value stored under the key, or nil if there is none.
+func (s *ConnectionState) Get(key string) interface{} {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	return s.storage[key]
+}
+
+// GetString returns the value stored under the key as a string, or "" if it isn't a string.
+func GetString(conn Connection, key string) string {
+	s, _ := conn.Get(key).(string)
+	return s
+}
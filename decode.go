@@ -0,0 +1,337 @@
+package conductor
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+)
+
+var (
+	// ErrTruncated is returned when a frame ends before the lengths in its header say it should.
+	ErrTruncated = errors.New("conductor: message truncated")
+
+	// ErrTooLarge is returned when a field of a frame is over its DecodeLimits,
+	// or when writing a message with a field too long for the size the frame has for it.
+	ErrTooLarge = errors.New("conductor: message too large")
+
+	// ErrTrailingData is returned when there are bytes left over after a legacy frame or inside an extension.
+	ErrTrailingData = errors.New("conductor: trailing data after message")
+
+	// ErrUnsupportedVersion is returned for a versioned frame newer than this package understands.
+	ErrUnsupportedVersion = errors.New("conductor: unsupported frame version")
+
+	// ErrAmbiguousOpcode is returned when writing a legacy frame with an opcode that would be read back as a versioned frame.
+	ErrAmbiguousOpcode = errors.New("conductor: opcode can't be written in a legacy frame")
+
+	// ErrFieldExtension is returned when writing or reading a message with an extension whose type maps to a field of Message,
+	// like ExtensionHeaders, since the field is what gets written.
+	ErrFieldExtension = errors.New("conductor: extension type is written from a field of the message")
+)
+
+// DecodeError describes which field of a frame failed to decode.
+// Use errors.Is with ErrTruncated, ErrTooLarge, ErrTrailingData, ErrUnsupportedVersion or ErrFieldExtension to check the reason.
+type DecodeError struct {
+	Field string // Field is the part of the frame that was being decoded.
+	Err   error  // Err is the reason decoding failed.
+}
+
+func (e *DecodeError) Error() string {
+	return fmt.Sprintf("%s: %s", e.Err.Error(), e.Field)
+}
+
+// Unwrap returns the reason decoding failed.
+func (e *DecodeError) Unwrap() error {
+	return e.Err
+}
+
+// DecodeLimits bounds the size of each field of a decoded message.
+// A limit of zero means the field isn't limited (beyond the size of the frame itself).
+type DecodeLimits struct {
+	MaxUuidSize        int // MaxUuidSize is the most bytes allowed in the uuid.
+	MaxSenderSize      int // MaxSenderSize is the most bytes allowed in the sender.
+	MaxChannelNameSize int // MaxChannelNameSize is the most bytes allowed in the channel name.
+	MaxBodySize        int // MaxBodySize is the most bytes allowed in the body.
+	MaxExtensions      int // MaxExtensions is the most extensions allowed on a message.
+	MaxExtensionSize   int // MaxExtensionSize is the most bytes allowed in the value of an extension.
+	MaxHeaders         int // MaxHeaders is the most headers allowed on a message.
+}
+
+// DefaultDecodeLimits are the limits used by Unmarshal.
+var DefaultDecodeLimits = DecodeLimits{
+	MaxUuidSize:        64,
+	MaxSenderSize:      256,
+	MaxChannelNameSize: defaultMaxChannelNameSize,
+	MaxBodySize:        defaultMaxMessageSize,
+	MaxExtensions:      64,
+	MaxExtensionSize:   64 * 1024,
+	MaxHeaders:         64,
+}
+
+// Check returns an ErrTooLarge DecodeError if the message is over any of the limits,
+// or an ErrFieldExtension one if it has an extension whose type maps to a field of Message.
+// Codecs that don't go through UnmarshalLimits can use this to get the same guarantees after decoding.
+func (l DecodeLimits) Check(m *Message) error {
+	if over(len(m.Uuid), l.MaxUuidSize) {
+		return &DecodeError{Field: "uuid", Err: ErrTooLarge}
+	}
+	if over(len(m.Sender), l.MaxSenderSize) {
+		return &DecodeError{Field: "sender", Err: ErrTooLarge}
+	}
+	if over(len(m.ChannelName), l.MaxChannelNameSize) {
+		return &DecodeError{Field: "channel name", Err: ErrTooLarge}
+	}
+	if over(len(m.Body), l.MaxBodySize) {
+		return &DecodeError{Field: "body", Err: ErrTooLarge}
+	}
+	if over(len(m.Extensions), l.MaxExtensions) {
+		return &DecodeError{Field: "extensions", Err: ErrTooLarge}
+	}
+	for _, ext := range m.Extensions {
+		if fieldExtension(ext.Type) {
+			return &DecodeError{Field: "extension type", Err: ErrFieldExtension}
+		}
+		if over(len(ext.Value), l.MaxExtensionSize) {
+			return &DecodeError{Field: "extension", Err: ErrTooLarge}
+		}
+	}
+	if over(len(m.Headers), l.MaxHeaders) {
+		return &DecodeError{Field: "headers", Err: ErrTooLarge}
+	}
+	if len(m.Headers) > 0 && over(headersSize(m.Headers), l.MaxExtensionSize) {
+		return &DecodeError{Field: "headers", Err: ErrTooLarge}
+	}
+	return nil
+}
+
+func over(size, limit int) bool {
+	return limit > 0 && size > limit
+}
+
+// isVersioned reports if the frame starts with the magic and a version. A legacy frame whose opcode's low byte
+// is the magic has a zero after it, which is never a version.
+func isVersioned(b []byte) bool {
+	return len(b) > 1 && b[0] == frameMagic && b[1] != LegacyFrameVersion
+}
+
+// Unmarshal converts a slice of bytes into a Message struct using the DefaultDecodeLimits.
+// Both legacy and versioned frames are accepted. The layout used is recorded in the Version of the message.
+func Unmarshal(b []byte) (*Message, error) {
+	return UnmarshalLimits(b, DefaultDecodeLimits)
+}
+
+// UnmarshalLimits is like Unmarshal, but checks the fields against the limits provided.
+// Every length is checked against the limits and the bytes left in the frame before anything is allocated.
+func UnmarshalLimits(b []byte, limits DecodeLimits) (*Message, error) {
+	var m Message
+	r := frameReader{b: b}
+	if isVersioned(b) {
+		r.off = 1
+		version, err := r.uint8("version")
+		if err != nil {
+			return nil, err
+		}
+		if version != FrameVersion {
+			return nil, &DecodeError{Field: "version", Err: ErrUnsupportedVersion}
+		}
+		m.Version = version
+		if m.Flags, err = r.uint16("flags"); err != nil {
+			return nil, err
+		}
+	}
+
+	var err error
+	if m.Opcode, err = r.uint16("opcode"); err != nil {
+		return nil, err
+	}
+
+	if m.Uuid, err = r.string("uuid", limits.MaxUuidSize); err != nil {
+		return nil, err
+	}
+
+	if m.ChannelName, err = r.string("channel name", limits.MaxChannelNameSize); err != nil {
+		return nil, err
+	}
+
+	bodySize, err := r.uint32("body size")
+	if err != nil {
+		return nil, err
+	}
+	if m.Body, err = r.bytes("body", int64(bodySize), limits.MaxBodySize); err != nil {
+		return nil, err
+	}
+
+	if m.Version == LegacyFrameVersion {
+		if r.remaining() > 0 {
+			return nil, &DecodeError{Field: "body", Err: ErrTrailingData}
+		}
+		return &m, nil
+	}
+	for r.remaining() > 0 {
+		if over(len(m.Extensions)+1, limits.MaxExtensions) {
+			return nil, &DecodeError{Field: "extensions", Err: ErrTooLarge}
+		}
+		var ext Extension
+		if ext.Type, err = r.uint16("extension type"); err != nil {
+			return nil, err
+		}
+		size, err := r.uint32("extension size")
+		if err != nil {
+			return nil, err
+		}
+		if ext.Type == ExtensionHeaders {
+			if m.Headers, err = r.headers(int64(size), limits); err != nil {
+				return nil, err
+			}
+			continue
+		}
+		if ext.Type == ExtensionSender {
+			sender, err := r.bytes("sender", int64(size), limits.MaxSenderSize)
+			if err != nil {
+				return nil, err
+			}
+			m.Sender = string(sender)
+			continue
+		}
+		if ext.Type == ExtensionSequence {
+			if m.Sequence, err = r.uint64("sequence", size); err != nil {
+				return nil, err
+			}
+			continue
+		}
+		if ext.Type == ExtensionTimestamp {
+			timestamp, err := r.uint64("timestamp", size)
+			if err != nil {
+				return nil, err
+			}
+			m.Timestamp = int64(timestamp)
+			continue
+		}
+		if ext.Value, err = r.bytes("extension", int64(size), limits.MaxExtensionSize); err != nil {
+			return nil, err
+		}
+		m.Extensions = append(m.Extensions, ext)
+	}
+
+	return &m, nil
+}
+
+// frameReader reads the fields of a frame, checking that each one fits in what is left of it.
+type frameReader struct {
+	b   []byte
+	off int
+}
+
+func (r *frameReader) remaining() int {
+	return len(r.b) - r.off
+}
+
+func (r *frameReader) next(field string, n int) ([]byte, error) {
+	if n > r.remaining() {
+		return nil, &DecodeError{Field: field, Err: ErrTruncated}
+	}
+	b := r.b[r.off : r.off+n]
+	r.off += n
+	return b, nil
+}
+
+func (r *frameReader) uint8(field string) (uint8, error) {
+	b, err := r.next(field, 1)
+	if err != nil {
+		return 0, err
+	}
+	return b[0], nil
+}
+
+func (r *frameReader) uint16(field string) (uint16, error) {
+	b, err := r.next(field, 2)
+	if err != nil {
+		return 0, err
+	}
+	return binary.LittleEndian.Uint16(b), nil
+}
+
+func (r *frameReader) uint32(field string) (uint32, error) {
+	b, err := r.next(field, 4)
+	if err != nil {
+		return 0, err
+	}
+	return binary.LittleEndian.Uint32(b), nil
+}
+
+// uint64 reads the value of an extension that holds a single uint64.
+func (r *frameReader) uint64(field string, size uint32) (uint64, error) {
+	if size > 8 {
+		return 0, &DecodeError{Field: field, Err: ErrTrailingData}
+	}
+	if size < 8 {
+		return 0, &DecodeError{Field: field, Err: ErrTruncated}
+	}
+	b, err := r.next(field, 8)
+	if err != nil {
+		return 0, err
+	}
+	return binary.LittleEndian.Uint64(b), nil
+}
+
+// bytes copies out size bytes, so the message doesn't hold onto the frame.
+func (r *frameReader) bytes(field string, size int64, limit int) ([]byte, error) {
+	if limit > 0 && size > int64(limit) {
+		return nil, &DecodeError{Field: field, Err: ErrTooLarge}
+	}
+	if size > int64(r.remaining()) {
+		return nil, &DecodeError{Field: field, Err: ErrTruncated}
+	}
+	b, _ := r.next(field, int(size))
+	return append([]byte{}, b...), nil
+}
+
+// headers reads the value of a headers extension, which must fill exactly size bytes.
+func (r *frameReader) headers(size int64, limits DecodeLimits) (map[string]string, error) {
+	if over(int(size), limits.MaxExtensionSize) {
+		return nil, &DecodeError{Field: "headers", Err: ErrTooLarge}
+	}
+	if size > int64(r.remaining()) {
+		return nil, &DecodeError{Field: "headers", Err: ErrTruncated}
+	}
+	end := r.off + int(size)
+	sub := frameReader{b: r.b[:end], off: r.off}
+	count, err := sub.uint16("header count")
+	if err != nil {
+		return nil, err
+	}
+	if over(int(count), limits.MaxHeaders) {
+		return nil, &DecodeError{Field: "headers", Err: ErrTooLarge}
+	}
+	headers := make(map[string]string, count)
+	for i := 0; i < int(count); i++ {
+		k, err := sub.string("header key", 0)
+		if err != nil {
+			return nil, err
+		}
+		v, err := sub.string("header value", 0)
+		if err != nil {
+			return nil, err
+		}
+		headers[k] = v
+	}
+	if sub.remaining() > 0 {
+		return nil, &DecodeError{Field: "headers", Err: ErrTrailingData}
+	}
+	r.off = end
+	return headers, nil
+}
+
+func (r *frameReader) string(field string, limit int) (string, error) {
+	size, err := r.uint16(field + " size")
+	if err != nil {
+		return "", err
+	}
+	if over(int(size), limit) {
+		return "", &DecodeError{Field: field, Err: ErrTooLarge}
+	}
+	b, err := r.next(field, int(size))
+	if err != nil {
+		return "", err
+	}
+	return string(b), nil
+}
@@ -0,0 +1,147 @@
+package conductor
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"testing"
+)
+
+func le16(v int) []byte {
+	return binary.LittleEndian.AppendUint16(nil, uint16(v))
+}
+
+func le32(v int) []byte {
+	return binary.LittleEndian.AppendUint32(nil, uint32(v))
+}
+
+func lenString(s string) []byte {
+	return append(le16(len(s)), s...)
+}
+
+// legacyFrame builds a legacy frame by hand, so the tests don't depend on the encoder.
+func legacyFrame(opcode int, uuid, channelName string, body []byte) []byte {
+	b := le16(opcode)
+	b = append(b, lenString(uuid)...)
+	b = append(b, lenString(channelName)...)
+	b = append(b, le32(len(body))...)
+	return append(b, body...)
+}
+
+// versionedFrame builds a versioned frame by hand, with the extensions (see extension) after the body.
+func versionedFrame(opcode int, uuid, channelName string, body []byte, extensions ...[]byte) []byte {
+	b := append([]byte{frameMagic, FrameVersion}, le16(0)...)
+	b = append(b, legacyFrame(opcode, uuid, channelName, body)...)
+	for _, ext := range extensions {
+		b = append(b, ext...)
+	}
+	return b
+}
+
+func extension(extType int, value []byte) []byte {
+	b := append(le16(extType), le32(len(value))...)
+	return append(b, value...)
+}
+
+func TestUnmarshalLimits(t *testing.T) {
+	bigHeaders := append(le16(1), lenString("k")...)
+	bigHeaders = append(bigHeaders, lenString(string(bytes.Repeat([]byte("v"), 100)))...)
+	tests := []struct {
+		name   string
+		frame  []byte
+		limits DecodeLimits
+		err    error
+		field  string
+	}{
+		{name: "legacy", frame: legacyFrame(WriteOpcode, "u", "c", []byte("body"))},
+		{name: "versioned", frame: versionedFrame(WriteOpcode, "u", "c", []byte("body"),
+			extension(ExtensionHeaders, append(le16(1), append(lenString("k"), lenString("v")...)...)),
+			extension(ExtensionSequence, make([]byte, 8)), extension(0x9000, []byte("x")))},
+
+		{name: "empty", frame: nil, err: ErrTruncated, field: "opcode"},
+		{name: "half an opcode", frame: []byte{1}, err: ErrTruncated, field: "opcode"},
+		{name: "short uuid", frame: append(le16(WriteOpcode), append(le16(10), "ab"...)...), err: ErrTruncated, field: "uuid"},
+		{name: "short body", frame: legacyFrame(WriteOpcode, "u", "c", nil)[:9], err: ErrTruncated, field: "body size"},
+		{name: "body size past the end", frame: append(legacyFrame(WriteOpcode, "u", "c", nil)[:9], append(le32(100), "abc"...)...),
+			err: ErrTruncated, field: "body"},
+		{name: "legacy trailing data", frame: append(legacyFrame(WriteOpcode, "u", "c", nil), 0), err: ErrTrailingData, field: "body"},
+		{name: "unsupported version", frame: []byte{frameMagic, 7, 0, 0}, err: ErrUnsupportedVersion, field: "version"},
+
+		{name: "uuid too large", frame: legacyFrame(WriteOpcode, string(make([]byte, 65)), "c", nil), err: ErrTooLarge, field: "uuid"},
+		{name: "channel name too large", frame: legacyFrame(WriteOpcode, "u", string(make([]byte, 256)), nil), err: ErrTooLarge, field: "channel name"},
+		{name: "body too large", frame: legacyFrame(WriteOpcode, "u", "c", make([]byte, 10)), limits: DecodeLimits{MaxBodySize: 5},
+			err: ErrTooLarge, field: "body"},
+		{name: "body size over the limit before the body", frame: append(legacyFrame(WriteOpcode, "u", "c", nil)[:9], le32(0xFFFFFFFF)...),
+			err: ErrTooLarge, field: "body"},
+		{name: "sender too large", frame: versionedFrame(WriteOpcode, "u", "c", nil, extension(ExtensionSender, make([]byte, 257))),
+			err: ErrTooLarge, field: "sender"},
+		{name: "too many extensions", frame: versionedFrame(WriteOpcode, "u", "c", nil, extension(0x9000, nil), extension(0x9001, nil)),
+			limits: DecodeLimits{MaxExtensions: 1}, err: ErrTooLarge, field: "extensions"},
+		{name: "extension too large", frame: versionedFrame(WriteOpcode, "u", "c", nil, extension(0x9000, make([]byte, 10))),
+			limits: DecodeLimits{MaxExtensionSize: 5}, err: ErrTooLarge, field: "extension"},
+		{name: "short extension header", frame: versionedFrame(WriteOpcode, "u", "c", nil, le16(0x9000)), err: ErrTruncated, field: "extension size"},
+
+		{name: "too many headers", frame: versionedFrame(WriteOpcode, "u", "c", nil, extension(ExtensionHeaders, le16(65))),
+			err: ErrTooLarge, field: "headers"},
+		{name: "headers too large", frame: versionedFrame(WriteOpcode, "u", "c", nil, extension(ExtensionHeaders, bigHeaders)),
+			limits: DecodeLimits{MaxExtensionSize: 50}, err: ErrTooLarge, field: "headers"},
+		{name: "headers past the end", frame: append(versionedFrame(WriteOpcode, "u", "c", nil), append(le16(ExtensionHeaders), le32(100)...)...),
+			err: ErrTruncated, field: "headers"},
+		{name: "headers trailing data", frame: versionedFrame(WriteOpcode, "u", "c", nil, extension(ExtensionHeaders, append(le16(0), 0))),
+			err: ErrTrailingData, field: "headers"},
+		{name: "header key past the headers", frame: versionedFrame(WriteOpcode, "u", "c", nil, extension(ExtensionHeaders, append(le16(1), le16(3)...))),
+			err: ErrTruncated, field: "header key"},
+
+		{name: "short sequence", frame: versionedFrame(WriteOpcode, "u", "c", nil, extension(ExtensionSequence, make([]byte, 4))),
+			err: ErrTruncated, field: "sequence"},
+		{name: "long sequence", frame: versionedFrame(WriteOpcode, "u", "c", nil, extension(ExtensionSequence, make([]byte, 9))),
+			err: ErrTrailingData, field: "sequence"},
+		{name: "long timestamp", frame: versionedFrame(WriteOpcode, "u", "c", nil, extension(ExtensionTimestamp, make([]byte, 16))),
+			err: ErrTrailingData, field: "timestamp"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			limits := tt.limits
+			if limits == (DecodeLimits{}) {
+				limits = DefaultDecodeLimits
+			}
+			m, err := UnmarshalLimits(tt.frame, limits)
+			if tt.err == nil {
+				if err != nil {
+					t.Fatal(err)
+				}
+				if m.Uuid != "u" || m.ChannelName != "c" || string(m.Body) != "body" {
+					t.Fatalf("decoded %+v", m)
+				}
+				return
+			}
+			var de *DecodeError
+			if !errors.Is(err, tt.err) || !errors.As(err, &de) || de.Field != tt.field {
+				t.Fatalf("got %v, want %v in %s", err, tt.err, tt.field)
+			}
+		})
+	}
+}
+
+func TestCheck(t *testing.T) {
+	tests := []struct {
+		name    string
+		message Message
+		field   string
+	}{
+		{name: "uuid", message: Message{Uuid: string(make([]byte, 65))}, field: "uuid"},
+		{name: "sender", message: Message{Sender: string(make([]byte, 257))}, field: "sender"},
+		{name: "channel name", message: Message{ChannelName: string(make([]byte, 256))}, field: "channel name"},
+		{name: "extension", message: Message{Extensions: []Extension{{Type: 0x9000, Value: make([]byte, 64*1024+1)}}}, field: "extension"},
+		{name: "headers", message: Message{Headers: map[string]string{"k": string(make([]byte, 64*1024))}}, field: "headers"},
+	}
+	for _, tt := range tests {
+		var de *DecodeError
+		if err := DefaultDecodeLimits.Check(&tt.message); !errors.Is(err, ErrTooLarge) || !errors.As(err, &de) || de.Field != tt.field {
+			t.Fatalf("%s: %v", tt.name, err)
+		}
+	}
+	if err := DefaultDecodeLimits.Check(&Message{Uuid: "u", ChannelName: "c", Body: []byte("body")}); err != nil {
+		t.Fatal(err)
+	}
+}
@@ -1,11 +1,13 @@
 package conductor
 
 import (
+	"sync"
 	"time"
 )
 
 // DeDuplication is the based interface for handling deduplication of messages.
 // Use this for ensuring messages aren't processed twice in the hub.
+// The hub calls it from several goroutines at once, so it has to be safe for concurrent use.
 type DeDuplication interface {
 	Start()
 	Add(message *Message)
@@ -13,14 +15,35 @@ type DeDuplication interface {
 	IsDuplicate(message *Message) bool
 }
 
+// AtomicDeDuplication is an optional interface a DeDuplication can implement to check and add a message in one step.
+// Without it, the hub calls IsDuplicate and then Add, so two copies of a message arriving at once can both get through.
+type AtomicDeDuplication interface {
+	AddIfAbsent(message *Message) bool // AddIfAbsent adds the message unless it is a duplicate, in one step, and reports if it was added.
+}
+
+// addIfAbsent adds the message to the deduper unless it is a duplicate, and reports if it was added.
+func addIfAbsent(deduper DeDuplication, message *Message) bool {
+	if atomic, ok := deduper.(AtomicDeDuplication); ok {
+		return atomic.AddIfAbsent(message)
+	}
+	if deduper.IsDuplicate(message) {
+		return false
+	}
+	deduper.Add(message)
+	return true
+}
+
 // StandardDeDuplication is the default implmentation of DeDuplication.
 // It works by holding the message in memory for a period of time waiting to see if a duplication will arrive.
 // If "durablity" is enabled for the message it will be removed as soon as a message is fin'ed. - Might not do this...
-// TODO: look at possible race condition with the timestamps map...
+// It is safe for concurrent use, since the hub checks for duplicates from every connection's goroutine.
 type StandardDeDuplication struct {
+	mu         sync.Mutex
 	timestamps map[string]time.Time
 	ttl        time.Duration //ttl is Time To Live in the timestamp list. A good default value for this is X seconds.
 	ticker     *time.Ticker
+	done       chan struct{}
+	stopOnce   sync.Once
 }
 
 // NewDeDuper creates a StandardDeDuplication to use.
@@ -29,7 +52,8 @@ type StandardDeDuplication struct {
 func NewDeDuper(tick, ttl time.Duration) *StandardDeDuplication {
 	return &StandardDeDuplication{timestamps: make(map[string]time.Time),
 		ticker: time.NewTicker(ttl),
-		ttl:    ttl}
+		ttl:    ttl,
+		done:   make(chan struct{})}
 }
 
 // Start kicks off the ticker so it can do a sweep based on the ttl and cleanup any stale messages
@@ -38,17 +62,28 @@ func (deduper *StandardDeDuplication) Start() {
 	go deduper.doTick()
 }
 
+// Stop ends the cleanup sweep started by Start.
+func (deduper *StandardDeDuplication) Stop() {
+	deduper.stopOnce.Do(func() {
+		close(deduper.done)
+	})
+}
+
 // Add puts a timestamp in the timestamps map based on the message's ID.
 // The message will then be checked in the ticker's clean up sweep to remove the message if it is past the ttl.
 func (deduper *StandardDeDuplication) Add(message *Message) {
 	if len(message.Uuid) == 0 {
 		return
 	}
+	deduper.mu.Lock()
+	defer deduper.mu.Unlock()
 	deduper.timestamps[message.Uuid] = time.Now()
 }
 
 // Remove removes a message based on the ID of the message from the timestamp map.
 func (deduper *StandardDeDuplication) Remove(message *Message) {
+	deduper.mu.Lock()
+	defer deduper.mu.Unlock()
 	delete(deduper.timestamps, message.Uuid)
 }
 
@@ -57,10 +92,27 @@ func (deduper *StandardDeDuplication) IsDuplicate(message *Message) bool {
 	if len(message.Uuid) == 0 {
 		return false
 	}
+	deduper.mu.Lock()
+	defer deduper.mu.Unlock()
 	_, exist := deduper.timestamps[message.Uuid]
 	return exist
 }
 
+// AddIfAbsent adds the message if it isn't a duplicate and reports if it was added.
+// Checking and adding happen under the same lock, so two copies of a message arriving at once can't both get through.
+func (deduper *StandardDeDuplication) AddIfAbsent(message *Message) bool {
+	if len(message.Uuid) == 0 {
+		return true
+	}
+	deduper.mu.Lock()
+	defer deduper.mu.Unlock()
+	if _, exist := deduper.timestamps[message.Uuid]; exist {
+		return false
+	}
+	deduper.timestamps[message.Uuid] = time.Now()
+	return true
+}
+
 func (deduper *StandardDeDuplication) doTick() {
 	defer func() {
 		deduper.ticker.Stop()
@@ -70,11 +122,15 @@ func (deduper *StandardDeDuplication) doTick() {
 		select {
 		case <-deduper.ticker.C:
 			deduper.cleanupSweep()
+		case <-deduper.done:
+			return
 		}
 	}
 }
 
 func (deduper *StandardDeDuplication) cleanupSweep() {
+	deduper.mu.Lock()
+	defer deduper.mu.Unlock()
 	now := time.Now()
 	for key := range deduper.timestamps {
 		start := deduper.timestamps[key]
@@ -0,0 +1,47 @@
+package conductor
+
+import (
+	"sync"
+	"testing"
+	"time"
+)
+
+// setDeDuplication is a DeDuplication without AddIfAbsent, like the ones written before it existed.
+type setDeDuplication struct {
+	mu   sync.Mutex
+	seen map[string]bool
+}
+
+func (d *setDeDuplication) Start() {}
+
+func (d *setDeDuplication) Add(message *Message) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	d.seen[message.Uuid] = true
+}
+
+func (d *setDeDuplication) Remove(message *Message) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	delete(d.seen, message.Uuid)
+}
+
+func (d *setDeDuplication) IsDuplicate(message *Message) bool {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	return d.seen[message.Uuid]
+}
+
+func TestAddIfAbsent(t *testing.T) {
+	for _, deduper := range []DeDuplication{&setDeDuplication{seen: make(map[string]bool)}, NewDeDuper(time.Second, time.Second)} {
+		message := &Message{Uuid: newUUID()}
+		if !addIfAbsent(deduper, message) {
+			t.Fatalf("%T: first copy was a duplicate", deduper)
+		}
+		if addIfAbsent(deduper, message) {
+			t.Fatalf("%T: second copy wasn't a duplicate", deduper)
+		}
+	}
+	// a deduper without AddIfAbsent can still run a server.
+	New(0, &setDeDuplication{seen: make(map[string]bool)}, nil, nil, nil, nil)
+}
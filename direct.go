@@ -0,0 +1,115 @@
+package conductor
+
+import (
+	"sync"
+	"time"
+)
+
+// directAckTimeout is how long a direct message passed on to the sisters waits for one of them to deliver it,
+// before the client that asked for an ack gets a nack.
+const directAckTimeout = 5 * time.Second
+
+// directMessage delivers a DirectOpcode message to the local connections it is addressed to
+// and passes it on to the sisters, which deliver it to theirs.
+// A message to a connection ID is only passed on if the connection isn't here, while one to an identity
+// always is, since the identity can have connections on every server.
+// A message that asked for an ack is acked once it is delivered here, or once a sister acks that it delivered it.
+// If neither happens, it is nacked with ErrCodeUnknownRecipient (after the directAckTimeout, if it was passed on).
+func (h *MultiPlexHub) directMessage(data *hubData) {
+	if !data.isSister {
+		if h.auther != nil && !h.auther.CanDirect(data.conn, data.message) {
+			h.acknowledge(data, &ProtocolError{Code: ErrCodeUnauthorized, Reason: "direct message not allowed"})
+			return //no direct access!
+		}
+		data.message.Timestamp = time.Now().UnixNano()
+	}
+
+	var targets []Connection
+	byIdentity := data.message.Flags&FlagDirectToIdentity != 0
+	if byIdentity {
+		targets = h.registry.getBy(IdentityKey, data.message.ChannelName)
+	} else if conn := h.registry.get(data.message.ChannelName); conn != nil {
+		targets = []Connection{conn}
+	}
+	for _, conn := range targets {
+		if conn != data.conn {
+			conn.Write(data.message)
+		}
+	}
+	delivered := len(targets) > 0
+	wantsAck := data.message.Flags&FlagAckRequested != 0
+	if delivered && wantsAck && data.isSister {
+		// tell the sister, so it can ack the client that sent it.
+		data.conn.Write(&Message{Opcode: AckOpcode, ChannelName: data.message.ChannelName, Uuid: data.message.Uuid})
+	}
+
+	if (!delivered || byIdentity) && h.sisterManager != nil {
+		if !delivered && wantsAck {
+			// only a sister that has the recipient acks, so the answer waits on them.
+			h.directs.add(data.message.Uuid, data.conn, func() {
+				h.acknowledge(data, &ProtocolError{Code: ErrCodeUnknownRecipient, Reason: "no server delivered the direct message"})
+			})
+		}
+		h.sisterManager.Write(data.message)
+		if !delivered {
+			return
+		}
+	}
+	if !delivered {
+		h.acknowledge(data, &ProtocolError{Code: ErrCodeUnknownRecipient, Reason: "nobody to deliver the direct message to"})
+		return
+	}
+	h.acknowledge(data, nil)
+}
+
+// directDelivered passes the ack of a sister that delivered a direct message on to the connection that sent it,
+// which is either the client that asked for the ack or the sister that passed the message on to us.
+func (h *MultiPlexHub) directDelivered(ack *Message) {
+	if from := h.directs.take(ack.Uuid); from != nil {
+		from.Write(ack)
+	}
+}
+
+// pendingDirects are the direct messages that were passed on to the sisters and asked for an ack, by Uuid.
+// Acks come in on the sister connections, which belong to other shards, so it is guarded.
+type pendingDirects struct {
+	mu      sync.Mutex
+	waiting map[string]*pendingDirect
+}
+
+// pendingDirect is where the ack of a direct message goes, and the timer that gives up on it.
+type pendingDirect struct {
+	from  Connection
+	timer *time.Timer
+}
+
+// add waits for an ack of the message with the Uuid, calling expired if none comes in the directAckTimeout.
+func (p *pendingDirects) add(uuid string, from Connection, expired func()) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.waiting == nil {
+		p.waiting = make(map[string]*pendingDirect)
+	}
+	if _, ok := p.waiting[uuid]; ok {
+		return // a retry of a message that is already waiting.
+	}
+	p.waiting[uuid] = &pendingDirect{from: from, timer: time.AfterFunc(directAckTimeout, func() {
+		if p.take(uuid) != nil {
+			expired()
+		}
+	})}
+}
+
+// take stops waiting for an ack of the message with the Uuid, returning the connection the ack goes to.
+// It returns nil if the message isn't waiting (anymore), like when another sister already acked it.
+func (p *pendingDirects) take(uuid string) Connection {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	pending, ok := p.waiting[uuid]
+	if !ok {
+		return nil
+	}
+	pending.timer.Stop()
+	delete(p.waiting, uuid)
+	return pending.from
+}
@@ -0,0 +1,353 @@
+package conductor
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+)
+
+// The HTTP fallback is for clients behind proxies that kill websocket upgrades.
+// A POST without a session opens one, and answers with its sessionInfo. From then on every request has the
+// session query parameter:
+//   - GET with an Accept of text/event-stream streams messages down as Server-Sent Events.
+//   - any other GET is a long-poll, which answers with a JSON array of messages once there are any,
+//     or an empty one after the PollTimeout.
+//   - POST sends a JSON message (or a JSON array of them) up to the hub, like a websocket frame would.
+//   - DELETE closes the session.
+//
+// Messages are always JSON (the JSONCodec), since that is what browsers can deal with over plain HTTP.
+// Only one request can be receiving messages at a time. A new one takes over from the old one, which returns.
+// A session that goes the PongWait without a request, and without anybody receiving messages on it, is disconnected.
+//
+// Delivery is at most once. A message is taken off the queue before it is written, so one in an event or a poll
+// response that never makes it to the client (like when the network drops the response) is gone.
+// When the server shuts down, a session is kept until its queued messages are picked up, or for the PongWait.
+const sessionParam = "session"
+
+// sessionInfo is the answer to a request that opens a session.
+type sessionInfo struct {
+	Session string `json:"session"` // Session is the secret that goes in the session query parameter of every request.
+	ID      string `json:"id"`      // ID is the ID the server assigned to the connection.
+}
+
+// httpconnection is a Connection over plain HTTP requests, for the SSE, long-poll and POST fallback.
+type httpconnection struct {
+	// the session secret the requests use. It isn't the ID, since the ID is shown to other clients (like in presence).
+	session string
+
+	// the hub, channels, codec (which is always JSON), limits and the messages waiting for a request to pick them up.
+	queuedConnection
+
+	// closed once the hub knows about the connection, so the request that opened the session can answer.
+	started chan struct{}
+
+	// guards downstream, which is closed when another request takes over receiving messages, and idle.
+	mu         sync.Mutex
+	downstream chan struct{}
+
+	// signaled when a request is done receiving messages, so a session that is going away knows to check its queue.
+	detached chan struct{}
+
+	// disconnects the session once nobody has been receiving messages on it for the PongWait.
+	idle *time.Timer
+}
+
+func newHTTPConnection(h HubConnection, options ServerOptions) *httpconnection {
+	c := &httpconnection{session: newUUID(), started: make(chan struct{}), detached: make(chan struct{}, 1)}
+	c.setup(c, h, false, &JSONCodec{}, options)
+	c.mu.Lock()
+	c.idle = time.AfterFunc(c.options.PongWait, c.Disconnect)
+	c.mu.Unlock()
+	return c
+}
+
+//FallbackHandler serves clients that can't open a websocket, using Server-Sent Events, long-polling and POST requests.
+//The connections it makes go to the same hub, so auth, binds and writes work just like they do over a websocket.
+//WebsocketHandler hands it every request that isn't a websocket upgrade, so there is no need to install it as well.
+func (s *Server) FallbackHandler(w http.ResponseWriter, r *http.Request) {
+	session := r.URL.Query().Get(sessionParam)
+	if session == "" {
+		if r.Method != "POST" {
+			http.Error(w, "Missing session", 400)
+			return
+		}
+		s.openSession(w, r)
+		return
+	}
+
+	s.mu.Lock()
+	c, ok := s.sessions[session]
+	s.mu.Unlock()
+	if !ok {
+		http.Error(w, "Unknown session", 404)
+		return
+	}
+	c.touch()
+	switch r.Method {
+	case "GET":
+		if strings.Contains(r.Header.Get("Accept"), "text/event-stream") {
+			c.streamEvents(w, r)
+		} else {
+			c.poll(w, r)
+		}
+	case "POST":
+		c.receive(w, r)
+	case "DELETE":
+		c.Disconnect()
+		w.WriteHeader(http.StatusNoContent)
+	default:
+		http.Error(w, "Method not allowed", 405)
+	}
+}
+
+// openSession creates an httpconnection and serves it until it disconnects, which outlives the request.
+func (s *Server) openSession(w http.ResponseWriter, r *http.Request) {
+	if !s.startHandler() {
+		http.Error(w, "Server is shutting down", 503)
+		return
+	}
+	if s.h.Auth() != nil && !s.h.Auth().IsValid(r) {
+		s.handlers.Done()
+		http.Error(w, "Not authorized", 401)
+		return
+	}
+
+	c := newHTTPConnection(s.h, s.connectionOptions())
+	s.mu.Lock()
+	if s.sessions == nil {
+		s.sessions = make(map[string]*httpconnection)
+	}
+	s.sessions[c.session] = c
+	s.mu.Unlock()
+	go func() {
+		defer s.handlers.Done()
+		s.serve(r, c, false)
+		s.mu.Lock()
+		delete(s.sessions, c.session)
+		s.mu.Unlock()
+	}()
+	<-c.started // ConnToRequest is done with the request by now.
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(sessionInfo{Session: c.session, ID: c.id})
+}
+
+// ReadLoop keeps the session alive until it is disconnected. Messages come in on their own requests, not here.
+// A session that is going away is kept until its queued messages are picked up, or for the PongWait,
+// since the client is likely between polls.
+func (c *httpconnection) ReadLoop(hub HubConnection) {
+	close(c.started)
+	<-c.queue.done
+	if c.queue.closeReason() == errGoingAway {
+		timer := time.NewTimer(c.options.PongWait)
+		defer timer.Stop()
+	wait:
+		for c.queue.depth() > 0 {
+			select {
+			case <-c.detached:
+			case <-timer.C:
+				break wait
+			}
+		}
+	}
+	c.Disconnect()
+}
+
+//Disconnect removes the connection from the hub and ends the session.
+func (c *httpconnection) Disconnect() {
+	c.mu.Lock()
+	c.idle.Stop()
+	c.mu.Unlock()
+	c.queuedConnection.Disconnect()
+}
+
+// attach makes the request the one receiving messages. The channel it returns is closed when another request takes over.
+func (c *httpconnection) attach() chan struct{} {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.downstream != nil {
+		close(c.downstream)
+	}
+	c.downstream = make(chan struct{})
+	c.idle.Stop()
+	return c.downstream
+}
+
+// touch restarts the idle timer, since the client just made a request. A session with a request receiving messages
+// doesn't have the timer running, so it is left alone.
+func (c *httpconnection) touch() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.downstream == nil {
+		c.idle.Reset(c.options.PongWait)
+	}
+}
+
+// detach is called when a request is done receiving messages. The session is disconnected if nobody takes over in time.
+func (c *httpconnection) detach(downstream chan struct{}) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.downstream == downstream {
+		c.downstream = nil
+		c.idle.Reset(c.options.PongWait)
+	}
+	select {
+	case c.detached <- struct{}{}:
+	default:
+	}
+}
+
+// receive hands the messages in the body of a POST to the hub.
+func (c *httpconnection) receive(w http.ResponseWriter, r *http.Request) {
+	select {
+	case <-c.queue.done:
+		http.Error(w, "Session closed", 410)
+		return
+	default:
+	}
+	body, err := io.ReadAll(http.MaxBytesReader(w, r.Body, c.options.MaxMessageSize))
+	if err != nil {
+		http.Error(w, "Body too large", 413)
+		return
+	}
+	messages, err := c.decodeMessages(body)
+	if err != nil {
+		http.Error(w, "Bad message", 400)
+		return
+	}
+	for _, message := range messages {
+		c.h.Write(c, message)
+	}
+	w.WriteHeader(http.StatusAccepted)
+}
+
+// decodeMessages decodes a JSON message, or a JSON array of them, making sure each is within the decode limits.
+func (c *httpconnection) decodeMessages(body []byte) ([]*Message, error) {
+	body = bytes.TrimSpace(body)
+	raw := []json.RawMessage{body}
+	if len(body) > 0 && body[0] == '[' {
+		raw = nil
+		if err := json.Unmarshal(body, &raw); err != nil {
+			return nil, err
+		}
+	}
+	messages := make([]*Message, 0, len(raw))
+	for _, b := range raw {
+		message, err := c.decodeMessage(b)
+		if err != nil {
+			return nil, err
+		}
+		messages = append(messages, message)
+	}
+	return messages, nil
+}
+
+// streamEvents sends the messages down as Server-Sent Events until the request goes away, another request
+// takes over or the session ends. A comment goes out every PingPeriod, so proxies don't close an idle stream.
+func (c *httpconnection) streamEvents(w http.ResponseWriter, r *http.Request) {
+	downstream := c.attach()
+	defer c.detach(downstream)
+	rc := http.NewResponseController(w)
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.Header().Set("X-Accel-Buffering", "no") // keep nginx from buffering the stream.
+	w.WriteHeader(http.StatusOK)
+	if err := rc.Flush(); err != nil {
+		return // streaming isn't supported, so the client has to long-poll.
+	}
+
+	ticker := time.NewTicker(c.options.PingPeriod)
+	defer ticker.Stop()
+	for {
+		var err error
+		select {
+		case out := <-c.queue.messages:
+			err = c.writeEvent(w, rc, out)
+			if err == nil && len(c.queue.messages) == 0 {
+				err = rc.Flush()
+			}
+		case <-ticker.C:
+			if _, err = io.WriteString(w, ":\n\n"); err == nil {
+				err = rc.Flush()
+			}
+		case <-c.queue.done:
+			if c.queue.closeReason() != ErrSlowConsumer {
+				c.drain(func(out outbound) error { return c.writeEvent(w, rc, out) })
+				rc.Flush()
+			}
+			return
+		case <-downstream:
+			return
+		case <-r.Context().Done():
+			return
+		}
+		if err != nil {
+			return
+		}
+	}
+}
+
+// writeEvent writes a message from the queue as an event, giving up after the WriteWait.
+func (c *httpconnection) writeEvent(w http.ResponseWriter, rc *http.ResponseController, out outbound) error {
+	rc.SetWriteDeadline(time.Now().Add(c.options.WriteWait))
+	defer rc.SetWriteDeadline(time.Time{})
+	return c.writeEncoded(out, func(buf []byte) error {
+		_, err := fmt.Fprintf(w, "data: %s\n\n", buf)
+		return err
+	})
+}
+
+// poll answers with the queued messages as soon as there are any, or with none after the PollTimeout.
+func (c *httpconnection) poll(w http.ResponseWriter, r *http.Request) {
+	downstream := c.attach()
+	defer c.detach(downstream)
+	timer := time.NewTimer(c.options.PollTimeout)
+	defer timer.Stop()
+
+	batch := []json.RawMessage{}
+	add := func(out outbound) error {
+		return c.writeEncoded(out, func(buf []byte) error {
+			batch = append(batch, append(json.RawMessage(nil), buf...)) // the buffer goes back into a pool.
+			return nil
+		})
+	}
+	select {
+	case out := <-c.queue.messages:
+		add(out)
+		c.drain(add)
+	case <-c.queue.done:
+		if c.queue.closeReason() != ErrSlowConsumer {
+			c.drain(add)
+		}
+		if len(batch) == 0 {
+			http.Error(w, "Session closed", 410)
+			return
+		}
+	case <-timer.C:
+	case <-downstream:
+	case <-r.Context().Done():
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Cache-Control", "no-cache")
+	json.NewEncoder(w).Encode(batch)
+}
+
+// drain hands whatever is in the queue to write, without waiting for more.
+func (c *httpconnection) drain(write func(out outbound) error) {
+	for {
+		select {
+		case out := <-c.queue.messages:
+			if err := write(out); err != nil {
+				return
+			}
+		default:
+			return
+		}
+	}
+}
@@ -0,0 +1,309 @@
+package conductor
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+// fallbackServer starts a server with options, and an HTTP server for its FallbackHandler.
+func fallbackServer(t *testing.T, options ServerOptions) (*Server, *httptest.Server) {
+	s := New(0, nil, NewSimpleAuth(), nil, nil, nil)
+	s.Options = options
+	s.Start(false)
+	ts := httptest.NewServer(http.HandlerFunc(s.FallbackHandler))
+	t.Cleanup(ts.Close)
+	return s, ts
+}
+
+// openFallbackSession opens a session and makes sure the server knows its connection.
+func openFallbackSession(t *testing.T, s *Server, u string) sessionInfo {
+	resp, err := http.Post(u, "application/json", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	var info sessionInfo
+	if err := json.NewDecoder(resp.Body).Decode(&info); err != nil || info.Session == "" {
+		t.Fatalf("opening a session: %s %v", resp.Status, err)
+	}
+	if s.Lookup(info.ID) == nil {
+		t.Fatalf("session %s is not registered", info.ID)
+	}
+	return info
+}
+
+// postMessages sends the messages up in one POST, and returns its status.
+func postMessages(t *testing.T, u, session string, messages ...*Message) int {
+	raw := make([]json.RawMessage, 0, len(messages))
+	for _, message := range messages {
+		buf, err := (&JSONCodec{}).Marshal(message)
+		if err != nil {
+			t.Fatal(err)
+		}
+		raw = append(raw, buf)
+	}
+	body, _ := json.Marshal(raw)
+	resp, err := http.Post(u+"?session="+session, "application/json", bytes.NewReader(body))
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	return resp.StatusCode
+}
+
+// pollMessages long-polls the session, and returns the messages along with the status.
+func pollMessages(t *testing.T, u, session string) ([]*Message, int) {
+	resp, err := http.Get(u + "?session=" + session)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, resp.StatusCode
+	}
+	var raw []json.RawMessage
+	if err := json.NewDecoder(resp.Body).Decode(&raw); err != nil {
+		t.Fatal(err)
+	}
+	messages := make([]*Message, 0, len(raw))
+	for _, buf := range raw {
+		message, err := (&JSONCodec{}).Unmarshal(buf)
+		if err != nil {
+			t.Fatal(err)
+		}
+		messages = append(messages, message)
+	}
+	return messages, resp.StatusCode
+}
+
+// bindFallback binds the session to the channel and polls until the bind is acked.
+func bindFallback(t *testing.T, u, session, channelName string) {
+	if status := postMessages(t, u, session, &Message{Opcode: BindOpcode, ChannelName: channelName, Uuid: newUUID(), Flags: FlagAckRequested}); status != http.StatusAccepted {
+		t.Fatalf("bind status %d", status)
+	}
+	messages, _ := pollMessages(t, u, session)
+	if len(messages) != 1 || messages[0].Opcode != AckOpcode {
+		t.Fatalf("bind answered with %v", messages)
+	}
+}
+
+// TestFallbackRequests checks the requests that don't fit a session get an error status.
+func TestFallbackRequests(t *testing.T) {
+	s, ts := fallbackServer(t, DefaultServerOptions())
+	info := openFallbackSession(t, s, ts.URL)
+
+	tests := []struct {
+		name   string
+		method string
+		query  string
+		body   string
+		status int
+	}{
+		{"missing session", "GET", "", "", http.StatusBadRequest},
+		{"unknown session", "GET", "?session=nope", "", http.StatusNotFound},
+		{"bad message", "POST", "?session=" + info.Session, "{not json", http.StatusBadRequest},
+		{"bad method", "PUT", "?session=" + info.Session, "", http.StatusMethodNotAllowed},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			req, _ := http.NewRequest(test.method, ts.URL+test.query, strings.NewReader(test.body))
+			resp, err := http.DefaultClient.Do(req)
+			if err != nil {
+				t.Fatal(err)
+			}
+			resp.Body.Close()
+			if resp.StatusCode != test.status {
+				t.Fatalf("status %d, want %d", resp.StatusCode, test.status)
+			}
+		})
+	}
+}
+
+// TestFallbackPoll binds, writes and reads messages over POST and long-poll requests, then closes the session.
+func TestFallbackPoll(t *testing.T) {
+	options := DefaultServerOptions()
+	options.PollTimeout = 100 * time.Millisecond
+	s, ts := fallbackServer(t, options)
+	a := openFallbackSession(t, s, ts.URL)
+	b := openFallbackSession(t, s, ts.URL)
+
+	if messages, status := pollMessages(t, ts.URL, a.Session); status != http.StatusOK || len(messages) != 0 {
+		t.Fatalf("poll with nothing queued: %d %v", status, messages)
+	}
+	bindFallback(t, ts.URL, a.Session, "chat")
+	bindFallback(t, ts.URL, b.Session, "chat")
+	status := postMessages(t, ts.URL, b.Session,
+		&Message{Opcode: WriteOpcode, ChannelName: "chat", Uuid: newUUID(), Body: []byte("one")},
+		&Message{Opcode: WriteOpcode, ChannelName: "chat", Uuid: newUUID(), Body: []byte("two")})
+	if status != http.StatusAccepted {
+		t.Fatalf("write status %d", status)
+	}
+	var bodies []string
+	for len(bodies) < 2 {
+		messages, status := pollMessages(t, ts.URL, a.Session)
+		if status != http.StatusOK {
+			t.Fatalf("poll status %d", status)
+		}
+		for _, message := range messages {
+			bodies = append(bodies, string(message.Body))
+		}
+		if len(messages) == 0 {
+			t.Fatal("poll timed out before the writes came in")
+		}
+	}
+	if strings.Join(bodies, ",") != "one,two" {
+		t.Fatalf("got %v", bodies)
+	}
+
+	req, _ := http.NewRequest("DELETE", ts.URL+"?session="+a.Session, nil)
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusNoContent {
+		t.Fatalf("delete status %d", resp.StatusCode)
+	}
+	deadline := time.Now().Add(time.Second)
+	for s.Lookup(a.ID) != nil {
+		if time.Now().After(deadline) {
+			t.Fatal("closed session is still registered")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	if _, status := pollMessages(t, ts.URL, a.Session); status != http.StatusNotFound {
+		t.Fatalf("poll on a closed session: %d", status)
+	}
+}
+
+// TestFallbackEvents reads messages, and the comments that keep the stream open, as Server-Sent Events.
+func TestFallbackEvents(t *testing.T) {
+	options := DefaultServerOptions()
+	options.PingPeriod = 50 * time.Millisecond
+	s, ts := fallbackServer(t, options)
+	a := openFallbackSession(t, s, ts.URL)
+	b := openFallbackSession(t, s, ts.URL)
+	bindFallback(t, ts.URL, b.Session, "chat")
+
+	req, _ := http.NewRequest("GET", ts.URL+"?session="+a.Session, nil)
+	req.Header.Set("Accept", "text/event-stream")
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	if ct := resp.Header.Get("Content-Type"); ct != "text/event-stream" {
+		t.Fatalf("content type %q", ct)
+	}
+	lines := make(chan string, 16)
+	go func() {
+		defer close(lines)
+		scanner := bufio.NewScanner(resp.Body)
+		for scanner.Scan() {
+			if line := scanner.Text(); line != "" {
+				lines <- line
+			}
+		}
+	}()
+	next := func(comments bool) string {
+		timeout := time.After(time.Second)
+		for {
+			select {
+			case line, ok := <-lines:
+				if !ok {
+					t.Fatal("stream ended")
+				}
+				if comments || !strings.HasPrefix(line, ":") {
+					return line
+				}
+			case <-timeout:
+				t.Fatal("timed out waiting for an event")
+			}
+		}
+	}
+	event := func() *Message {
+		line := next(false)
+		if !strings.HasPrefix(line, "data: ") {
+			t.Fatalf("got %q instead of an event", line)
+		}
+		message, err := (&JSONCodec{}).Unmarshal([]byte(strings.TrimPrefix(line, "data: ")))
+		if err != nil {
+			t.Fatal(err)
+		}
+		return message
+	}
+
+	if line := next(true); line != ":" {
+		t.Fatalf("got %q instead of a comment", line)
+	}
+	postMessages(t, ts.URL, a.Session, &Message{Opcode: BindOpcode, ChannelName: "chat", Uuid: newUUID(), Flags: FlagAckRequested})
+	if ack := event(); ack.Opcode != AckOpcode {
+		t.Fatalf("bind answered with opcode %d", ack.Opcode)
+	}
+	postMessages(t, ts.URL, b.Session, &Message{Opcode: WriteOpcode, ChannelName: "chat", Uuid: newUUID(), Body: []byte("hi")})
+	if got := event(); got.Opcode != WriteOpcode || string(got.Body) != "hi" {
+		t.Fatalf("got opcode %d body %q", got.Opcode, got.Body)
+	}
+}
+
+// TestFallbackIdle checks a session nobody makes requests on is disconnected after the PongWait, and one that is used is kept.
+func TestFallbackIdle(t *testing.T) {
+	options := DefaultServerOptions()
+	options.PongWait = 200 * time.Millisecond
+	s, ts := fallbackServer(t, options)
+	idle := openFallbackSession(t, s, ts.URL)
+	active := openFallbackSession(t, s, ts.URL)
+
+	for i := 0; i < 5; i++ {
+		time.Sleep(100 * time.Millisecond)
+		if status := postMessages(t, ts.URL, active.Session, &Message{Opcode: ServerOpcode, Uuid: newUUID()}); status != http.StatusAccepted {
+			t.Fatalf("post status %d", status)
+		}
+	}
+	if s.Lookup(idle.ID) != nil {
+		t.Fatal("idle session was kept")
+	}
+	if s.Lookup(active.ID) == nil {
+		t.Fatal("active session was dropped")
+	}
+}
+
+// TestFallbackShutdownDrain checks Shutdown keeps a session until the messages it has queued are picked up.
+func TestFallbackShutdownDrain(t *testing.T) {
+	s, ts := fallbackServer(t, DefaultServerOptions())
+	a := openFallbackSession(t, s, ts.URL)
+	b := openFallbackSession(t, s, ts.URL)
+	bindFallback(t, ts.URL, a.Session, "chat")
+	bindFallback(t, ts.URL, b.Session, "chat")
+	postMessages(t, ts.URL, b.Session, &Message{Opcode: WriteOpcode, ChannelName: "chat", Uuid: newUUID(), Body: []byte("last"), Flags: FlagAckRequested})
+	if messages, _ := pollMessages(t, ts.URL, b.Session); len(messages) != 1 || messages[0].Opcode != AckOpcode {
+		t.Fatalf("write answered with %v", messages)
+	}
+
+	done := make(chan error, 1)
+	go func() {
+		ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+		defer cancel()
+		done <- s.Shutdown(ctx)
+	}()
+	time.Sleep(100 * time.Millisecond)
+	select {
+	case err := <-done:
+		t.Fatalf("shut down before the session was drained: %v", err)
+	default:
+	}
+	messages, status := pollMessages(t, ts.URL, a.Session)
+	if status != http.StatusOK || len(messages) != 1 || string(messages[0].Body) != "last" {
+		t.Fatalf("drain: %d %v", status, messages)
+	}
+	if err := <-done; err != nil {
+		t.Fatal(err)
+	}
+}
@@ -1,14 +1,39 @@
 package conductor
 
 import (
-	"fmt"
+	"context"
+	"runtime"
+	"sync"
+	"sync/atomic"
+	"time"
 )
 
 // ServerHubHandler is the based interface for handling one to one server message between the client and the server.
+// Process is called from several goroutines at once, so it has to be safe for concurrent use.
+// It runs on the goroutine of the connection that sent the message, not on a shard, so it can write to the hub
+// (or call Sync) without waiting on itself. The connection's next message waits for Process to return.
 type ServerHubHandler interface {
 	Process(conn Connection, message *Message)
 }
 
+// Reply sends a server message back to the connection that sent request.
+// It is meant to be used from ServerHubHandler.Process. The reply carries the headers provided,
+// with the correlation ID header set to the one on the request (or to the request's Uuid if it has none).
+func Reply(conn Connection, request *Message, body []byte, headers map[string]string) error {
+	reply := &Message{Opcode: ServerOpcode, ChannelName: "", Uuid: newUUID(), Body: body}
+	for k, v := range headers {
+		reply.SetHeader(k, v)
+	}
+	if reply.Header(HeaderCorrelationID) == "" {
+		correlationID := request.Header(HeaderCorrelationID)
+		if correlationID == "" {
+			correlationID = request.Uuid
+		}
+		reply.SetHeader(HeaderCorrelationID, correlationID)
+	}
+	return conn.Write(reply)
+}
+
 // HubConnection is the an interface to hide the other methods of the Hub.
 // This way `Connection`s can only write to the Hub and not call its other methods.
 type HubConnection interface {
@@ -23,21 +48,41 @@ type Hub interface {
 	Auth() ConnectionAuth                                    // This returns the current auther (if one is used)
 	SisterManager() SisterManager                            // This returns the current sister manager (if one is used)
 	ReceivedSisterMessage(conn Connection, message *Message) // Handle a sister message into this hub
+	SetValidator(validator MessageValidator)                 // Set the validator messages from clients go through (nil turns validation off)
+	SetChannelObserver(observer ChannelObserver)             // Set the observer notified about the life of channels (if any)
+	SetPresence(filter PresenceFilter)                       // Set which channels have presence (nil turns presence off)
+	SetChannelPolicies(provider ChannelPolicyProvider)       // Set the provider of channel policies (nil uses DefaultChannelPolicy)
+	Use(middleware ...Middleware)                            // Add middleware to the messages coming into the hub
+	Connected(conn Connection)                               // A client connected, so it is added to the registry
+	Disconnected(conn Connection)                            // A client disconnected, so it is removed from the registry
+	IndexKeys(keys ...string)                                // Index the registry by these Store keys too (IdentityKey always is)
+	Lookup(id string) Connection                             // Find a client by its ID (nil if there is none)
+	LookupBy(key, value string) []Connection                 // Find the clients with the value stored under an index key
+	Shutdown(ctx context.Context) error                      // Stop the run loop once the messages already in it are processed
 }
 
 type hubData struct {
 	conn     Connection
 	message  *Message
 	isSister bool
+
+	// how many shards still have to process a pattern bind or unbind, which goes to all of them.
+	remaining *int32
+
+	// set on the message-less hubData Sync sends to every shard. Each shard signals it once it gets to it.
+	synced chan struct{}
 }
 
 // MultiPlexHub is the standard hub that handles interaction between clients and other hubs.
+// Channels are spread across shards that each run on their own goroutine, so throughput scales with cores.
+// Messages on the same channel are always processed in the order they were written.
+// Every plugin (auth, deduper, storage, etc) can be called from several goroutines at once.
+// Apart from the ServerHubHandler, the plugins called while a message is processed (like CanBind, Store or the
+// ChannelObserver) run on the goroutine of a shard. They must not call the hub's Write or Sync and wait for it,
+// since the shard could be waiting on itself. Start a goroutine for that, or write to a connection instead.
 type MultiPlexHub struct {
-	// The connections on each channel.
-	channels map[string][]Connection
-
-	// The channel we get messages from the hub on.
-	messages chan *hubData
+	// The shards the channels are spread across.
+	shards []*hubShard
 
 	// The deduper implementation to use (if any).
 	deduper DeDuplication
@@ -53,17 +98,55 @@ type MultiPlexHub struct {
 
 	// The sisters registered with the hub
 	sisterManager SisterManager
+
+	// The validator implementation to use (if any).
+	validator MessageValidator
+
+	// The channel observer implementation to use (if any).
+	observer ChannelObserver
+
+	// Decides which channels have presence (if any).
+	presence PresenceFilter
+
+	// The channel policy implementation to use (if any).
+	policies ChannelPolicyProvider
+
+	// The connected clients, by ID and index keys.
+	registry *registry
+
+	// The middleware added with Use, and the chain of it that ends with dispatch.
+	middleware []Middleware
+	handler    HandlerFunc
+
+	// The direct messages passed on to the sisters that are waiting for one of them to ack the delivery.
+	directs pendingDirects
+
+	// Closed by Shutdown to stop the shards. running tracks the shards still going.
+	done     chan struct{}
+	stopOnce sync.Once
+	running  sync.WaitGroup
 }
 
-func newMultiPlexHub(deduper DeDuplication, auther ConnectionAuth, storer Storage,
+// NewMultiPlexHub creates a hub with the plugins provided, which can all be nil.
+// Server creates one for itself, so this is for running a hub without one, like with MemoryConnections in tests.
+// RunLoop has to be running before messages are written to it.
+func NewMultiPlexHub(deduper DeDuplication, auther ConnectionAuth, storer Storage,
 	serverHandler ServerHubHandler, sisterManager SisterManager) *MultiPlexHub {
-	return &MultiPlexHub{channels: make(map[string][]Connection),
-		messages:      make(chan *hubData),
+	shards := make([]*hubShard, runtime.GOMAXPROCS(0))
+	for i := range shards {
+		shards[i] = newHubShard()
+	}
+	h := &MultiPlexHub{shards: shards,
 		deduper:       deduper,
 		auther:        auther,
 		storer:        storer,
 		serverHandler: serverHandler,
-		sisterManager: sisterManager}
+		sisterManager: sisterManager,
+		validator:     NewStandardValidator(),
+		registry:      newRegistry(IdentityKey),
+		done:          make(chan struct{})}
+	h.handler = h.dispatchMessage
+	return h
 }
 
 // Auth returns the auther object for use in the server.
@@ -76,104 +159,404 @@ func (h *MultiPlexHub) SisterManager() SisterManager {
 	return h.sisterManager
 }
 
-// RunLoop is the loop that runs forever processing messages from connections.
+// SetValidator replaces the validator. Call this before RunLoop.
+func (h *MultiPlexHub) SetValidator(validator MessageValidator) {
+	h.validator = validator
+}
+
+// SetChannelObserver sets the observer notified about the life of channels. Call this before RunLoop.
+func (h *MultiPlexHub) SetChannelObserver(observer ChannelObserver) {
+	h.observer = observer
+}
+
+// SetPresence sets which channels have presence. Call this before RunLoop.
+func (h *MultiPlexHub) SetPresence(filter PresenceFilter) {
+	h.presence = filter
+}
+
+// SetChannelPolicies sets the provider of channel policies. Call this before RunLoop.
+func (h *MultiPlexHub) SetChannelPolicies(provider ChannelPolicyProvider) {
+	h.policies = provider
+}
+
+// Use adds middleware to the messages coming into the hub. Middleware added first sees messages first.
+// Call this before RunLoop.
+func (h *MultiPlexHub) Use(middleware ...Middleware) {
+	h.middleware = append(h.middleware, middleware...)
+	h.handler = chain(h.dispatchMessage, h.middleware)
+}
+
+// Connected adds the client to the registry, indexed by the values it has stored under the index keys.
+func (h *MultiPlexHub) Connected(conn Connection) {
+	h.registry.add(conn)
+}
+
+// Disconnected removes the client from the registry.
+func (h *MultiPlexHub) Disconnected(conn Connection) {
+	h.registry.remove(conn)
+}
+
+// IndexKeys adds Store keys to index the registry by. Call this before clients connect.
+func (h *MultiPlexHub) IndexKeys(keys ...string) {
+	h.registry.index(keys...)
+}
+
+// Lookup returns the client with the ID, or nil if there is none.
+func (h *MultiPlexHub) Lookup(id string) Connection {
+	return h.registry.get(id)
+}
+
+// LookupBy returns the clients with the value stored under the key, which has to be an index key.
+func (h *MultiPlexHub) LookupBy(key, value string) []Connection {
+	return h.registry.getBy(key, value)
+}
+
+// RunLoop is the loop that processes messages from connections until Shutdown is called.
+// It starts a goroutine for every shard and runs the first one itself.
 func (h *MultiPlexHub) RunLoop() {
 	if h.deduper != nil {
 		h.deduper.Start()
 	}
+	h.running.Add(len(h.shards))
+	for _, shard := range h.shards[1:] {
+		go h.shardLoop(shard)
+	}
+	h.shardLoop(h.shards[0])
+	h.running.Wait()
+}
+
+// Shutdown waits for the shards to process the messages they already have and stops the run loop.
+// Then the sisters and the deduper are stopped and the storage is flushed, if they implement Stopper and Flusher.
+// The sisters are only stopped once the shards are done (or ctx is), so the writes the shards still had get forwarded to them.
+// Messages written to the hub after Shutdown are dropped.
+func (h *MultiPlexHub) Shutdown(ctx context.Context) error {
+	h.stopOnce.Do(func() {
+		close(h.done)
+	})
+	err := waitContext(ctx, &h.running)
+	if stopper, ok := h.sisterManager.(Stopper); ok {
+		stopper.Stop()
+	}
+	if err != nil {
+		return err
+	}
+	if stopper, ok := h.deduper.(Stopper); ok {
+		stopper.Stop()
+	}
+	if flusher, ok := h.storer.(Flusher); ok {
+		return flusher.Flush()
+	}
+	return nil
+}
+
+// Sync waits until the shards have processed every message written to the hub before it was called,
+// so whatever they had to deliver has been written to the connections. Once the hub is shut down, it waits for
+// the shards to finish instead. Tests use it to check what was delivered without sleeping.
+// Don't call it from a plugin, since the shard running the plugin would be waiting on itself.
+func (h *MultiPlexHub) Sync() {
+	synced := make(chan struct{}, len(h.shards))
+	for _, shard := range h.shards {
+		select {
+		case shard.messages <- &hubData{synced: synced}:
+		case <-h.done:
+			h.running.Wait()
+			return
+		}
+	}
+	for range h.shards {
+		select {
+		case <-synced:
+		case <-h.done:
+			h.running.Wait()
+			return
+		}
+	}
+}
+
+// shardLoop processes the messages of the shard. Once the hub is shut down, it processes what is left and returns.
+func (h *MultiPlexHub) shardLoop(shard *hubShard) {
+	defer h.running.Done()
 	for { // blocking loop that waits for stimulation
 		select {
-		case data := <-h.messages:
+		case data := <-shard.messages:
 			if data != nil {
-				h.preProcessHubData(data)
+				h.processMessage(shard, data)
+			}
+		case <-h.done:
+			for {
+				select {
+				case data := <-shard.messages:
+					if data != nil {
+						h.processMessage(shard, data)
+					}
+				default:
+					return
+				}
 			}
 		}
 	}
 }
 
 // Write is the implementation of HubConnection. This way clients can write messages to the hub without being able to call RunLoop.
+// The message is validated, deduped and run through the middleware on the calling goroutine before it is handed to the shard that owns it.
 func (h *MultiPlexHub) Write(conn Connection, message *Message) {
-	h.messages <- &hubData{conn: conn, message: message, isSister: false}
+	h.preProcessHubData(&hubData{conn: conn, message: message, isSister: false})
 }
 
 // ReceivedSisterMessage is just like Write, expect it sets the isSister flag.
 func (h *MultiPlexHub) ReceivedSisterMessage(conn Connection, message *Message) {
-	h.messages <- &hubData{conn: conn, message: message, isSister: true}
+	h.preProcessHubData(&hubData{conn: conn, message: message, isSister: true})
+}
+
+// dispatchMessage is the HandlerFunc at the end of the middleware chain.
+func (h *MultiPlexHub) dispatchMessage(conn Connection, message *Message, fromSister bool) {
+	h.dispatch(&hubData{conn: conn, message: message, isSister: fromSister})
+}
+
+// dispatch hands the message to the shard that owns it.
+// Channel messages go to the shard of their channel, while the rest go to a shard picked by the connection,
+// so each connection's messages stay in order. Server messages are handled right away, on the calling goroutine.
+// A cleanup goes to every shard, as the connection could be on any of them.
+func (h *MultiPlexHub) dispatch(data *hubData) {
+	if op := data.message.Opcode; (op == BindOpcode || op == UnbindOpcode) && IsPattern(data.message.ChannelName) {
+		h.dispatchPattern(data)
+		return
+	}
+	switch data.message.Opcode {
+	case CleanUpOpcode:
+		for _, shard := range h.shards {
+			h.send(shard, data)
+		}
+	case ServerOpcode:
+		h.serverMessage(data) // see ServerHubHandler for why this doesn't go to a shard.
+	case MetaQueryOpcode, MetaQueryResponseOpcode, DirectOpcode:
+		h.send(h.shards[shardIndex(data.conn.ID(), len(h.shards))], data)
+	default:
+		h.send(h.shards[shardIndex(data.message.ChannelName, len(h.shards))], data)
+	}
+}
+
+// dispatchPattern hands a pattern bind or unbind to every shard, as the pattern can match channels on any of them.
+// The bind is authorized and the connection's channel list is updated here, so every shard sees the same thing,
+// and the last shard to process it sends the ack.
+func (h *MultiPlexHub) dispatchPattern(data *hubData) {
+	if data.message.Opcode == BindOpcode {
+		if h.auther != nil && !h.auther.CanBind(data.conn, data.message) {
+			h.acknowledge(data, &ProtocolError{Code: ErrCodeUnauthorized, Reason: "bind not allowed"})
+			return //no bind access!
+		}
+		if !data.conn.AddChannel(data.message.ChannelName) {
+			h.acknowledge(data, nil) // already bound to it.
+			return
+		}
+	} else {
+		data.conn.RemoveChannel(data.message.ChannelName)
+	}
+	remaining := int32(len(h.shards))
+	data.remaining = &remaining
+	for _, shard := range h.shards {
+		h.send(shard, data)
+	}
+}
+
+// send hands the message to the shard, unless the hub is shut down.
+func (h *MultiPlexHub) send(shard *hubShard, data *hubData) {
+	select {
+	case shard.messages <- data:
+	case <-h.done:
+	}
+}
+
+// handle runs the message through the middleware. A client's message that asked for an ack and was dropped by
+// the middleware (which didn't call next) is nacked, so the client isn't left waiting for an answer.
+func (h *MultiPlexHub) handle(data *hubData) {
+	if len(h.middleware) == 0 || data.isSister || data.message.Flags&FlagAckRequested == 0 {
+		h.handler(data.conn, data.message, data.isSister)
+		return
+	}
+	passed := false
+	chain(func(conn Connection, message *Message, fromSister bool) {
+		passed = true
+		h.dispatchMessage(conn, message, fromSister)
+	}, h.middleware)(data.conn, data.message, data.isSister)
+	if !passed {
+		h.acknowledge(data, &ProtocolError{Code: ErrCodeDropped, Reason: "dropped by middleware"})
+	}
 }
 
 func (h *MultiPlexHub) preProcessHubData(data *hubData) {
-	// TODO: validated message is legit here (it has a proper op code, id, etc)
+	if data.message.internal {
+		h.dispatch(data) // the middleware only sees messages from clients and sisters.
+		return
+	}
+	if data.isSister && data.message.Opcode == AckOpcode {
+		h.directDelivered(data.message) // it has the Uuid of the message it acks, so the deduper would drop it.
+		return
+	}
+	if !data.isSister && serverOnly(data.message.Opcode) {
+		perr := &ProtocolError{Code: ErrCodeUnknownOpcode, Reason: "opcode can only be sent by a sister server"}
+		data.conn.Write(perr.errorMessage(data.message))
+		return
+	}
+	// sisters already validated the message when their client sent it.
+	if !data.isSister && h.validator != nil {
+		if perr := h.validator.Validate(data.conn, data.message); perr != nil {
+			data.conn.Write(perr.errorMessage(data.message))
+			return
+		}
+	}
+	if !data.isSister {
+		// never trust the sender a client claims. Sisters are trusted to pass along the sender they stamped.
+		data.message.Sender = identityOf(data.conn)
+	}
 	if h.deduper != nil {
-		if !h.deduper.IsDuplicate(data.message) {
-			h.deduper.Add(data.message)
-			h.processMessage(data)
+		if addIfAbsent(h.deduper, data.message) {
+			h.handle(data)
+		} else {
+			// a retry of something we already handled. We don't know how that went, so don't claim it worked.
+			h.acknowledge(data, &ProtocolError{Code: ErrCodeDuplicate, Reason: "message was already handled"})
 		}
 	} else {
-		h.processMessage(data)
+		h.handle(data)
 	}
 }
 
-func (h *MultiPlexHub) processMessage(data *hubData) {
+func (h *MultiPlexHub) processMessage(shard *hubShard, data *hubData) {
+	if data.synced != nil {
+		data.synced <- struct{}{}
+		return
+	}
 	switch opcode := data.message.Opcode; opcode {
 	case BindOpcode:
-		h.bindConnectionToChannel(data)
+		h.bindConnectionToChannel(shard, data)
 	case UnbindOpcode:
-		h.unbindConnectionToChannel(data)
+		h.unbindConnectionToChannel(shard, data)
 	case WriteOpcode:
-		h.writeToChannel(data)
+		h.writeToChannel(shard, data)
 	case CleanUpOpcode:
-		h.connectionCleanup(data)
-	case ServerOpcode:
-		h.serverMessage(data)
+		h.connectionCleanup(shard, data)
 	case MetaQueryOpcode:
 		h.metaQueryMessage(data)
 	case MetaQueryResponseOpcode:
 		h.handleMetaQueryResponse(data)
+	case JoinOpcode, LeaveOpcode:
+		h.sisterPresence(shard, data)
+	case PresenceQueryOpcode:
+		h.presenceQuery(shard, data)
+	case DirectOpcode:
+		h.directMessage(data)
 	default:
 		break
 	}
 }
 
-func (h *MultiPlexHub) bindConnectionToChannel(data *hubData) {
+func (h *MultiPlexHub) bindConnectionToChannel(shard *hubShard, data *hubData) {
+	if data.remaining != nil {
+		shard.patterns.add(data.message.ChannelName, data.conn)
+		h.finishPattern(data)
+		return
+	}
 	if h.auther != nil && !h.auther.CanBind(data.conn, data.message) {
+		h.acknowledge(data, &ProtocolError{Code: ErrCodeUnauthorized, Reason: "bind not allowed"})
 		return //no bind access!
 	}
-	connections := h.channels[data.message.ChannelName]
-	connections = append(connections, data.conn)
-	h.channels[data.message.ChannelName] = connections
-	data.conn.SetChannels(append(data.conn.Channels(), data.message.ChannelName))
+	if data.conn.HasChannel(data.message.ChannelName) {
+		h.acknowledge(data, nil) // already bound to it.
+		return
+	}
+	var policy ChannelPolicy
+	if existing, ok := shard.channels[data.message.ChannelName]; ok {
+		policy = existing.policy
+	} else {
+		policy = h.channelPolicy(data.message.ChannelName)
+	}
+	if policy.Private && !data.isSister && !h.canBindPrivate(data.conn, data.message) {
+		h.acknowledge(data, &ProtocolError{Code: ErrCodeUnauthorized, Reason: "private channel"})
+		return //no private access!
+	}
+	ch, created := shard.channel(data.message.ChannelName)
+	if created {
+		ch.policy = policy
+		if h.observer != nil {
+			h.observer.ChannelCreated(data.message.ChannelName)
+		}
+	} else if ch.full() {
+		h.acknowledge(data, &ProtocolError{Code: ErrCodeChannelFull, Reason: "channel has the most subscribers it allows"})
+		return
+	}
+	ch.add(data.conn)
+	if h.observer != nil {
+		h.observer.Subscribed(data.message.ChannelName, data.conn)
+	}
+	h.announcePresence(shard, JoinOpcode, data.message.ChannelName, data.conn)
+	data.conn.AddChannel(data.message.ChannelName)
+	h.acknowledge(data, nil)
 }
 
-func (h *MultiPlexHub) unbindConnectionToChannel(data *hubData) {
-	h.removeConnection(data.message.ChannelName, data.conn)
-	for i, channel := range data.conn.Channels() {
-		if channel == data.message.ChannelName {
-			data.conn.SetChannels(append(data.conn.Channels()[:i], data.conn.Channels()[i+1:]...))
-			break
-		}
+// canBindPrivate checks if the auther lets the connection bind to a private channel.
+func (h *MultiPlexHub) canBindPrivate(conn Connection, message *Message) bool {
+	auther, ok := h.auther.(PrivateChannelAuth)
+	return ok && auther.CanBindPrivate(conn, message)
+}
+
+func (h *MultiPlexHub) unbindConnectionToChannel(shard *hubShard, data *hubData) {
+	if data.remaining != nil {
+		shard.patterns.remove(data.message.ChannelName, data.conn)
+		h.finishPattern(data)
+		return
 	}
+	h.removeConnection(shard, data.message.ChannelName, data.conn)
+	data.conn.RemoveChannel(data.message.ChannelName)
+	h.acknowledge(data, nil)
 }
 
-func (h *MultiPlexHub) writeToChannel(data *hubData) {
+// finishPattern acks a pattern bind or unbind once every shard has processed it.
+func (h *MultiPlexHub) finishPattern(data *hubData) {
+	if atomic.AddInt32(data.remaining, -1) == 0 {
+		h.acknowledge(data, nil)
+	}
+}
+
+func (h *MultiPlexHub) writeToChannel(shard *hubShard, data *hubData) {
 	if !data.isSister {
 		if h.auther != nil && !h.auther.CanWrite(data.conn, data.message) {
-			fmt.Println("blocked unauthorized message")
+			h.acknowledge(data, &ProtocolError{Code: ErrCodeUnauthorized, Reason: "write not allowed"})
 			return //no write access!
 		}
-		if h.storer != nil {
-			h.storer.Store(data.conn, data.message)
-		}
 	}
 
-	//send the message to our local clients on this channel
-	connections := h.channels[data.message.ChannelName]
-	for _, conn := range connections {
-		if data.conn == conn {
+	// stamp the ordering metadata. Sisters keep the time the write first hit a server,
+	// but the sequence is always local so our clients see one gap free sequence per channel.
+	// a write nobody here is subscribed to doesn't get a sequence, so channels without state don't get one either.
+	ch, ok := shard.channels[data.message.ChannelName]
+	if !ok {
+		ch = &channel{policy: h.channelPolicy(data.message.ChannelName)}
+	}
+	subscribers := shard.subscribers(ch, data.message.ChannelName)
+	if ok {
+		data.message.Sequence = ch.nextSequence()
+	} else if len(subscribers) > 0 {
+		data.message.Sequence = shard.retired.next(data.message.ChannelName)
+	} else {
+		data.message.Sequence = 0
+	}
+	if !data.isSister || data.message.Timestamp == 0 {
+		data.message.Timestamp = time.Now().UnixNano()
+	}
+
+	persist := h.storer != nil && ch.policy.Persist
+	if !data.isSister && persist {
+		h.storer.Store(data.conn, data.message)
+	}
+
+	//send the message to our local clients on this channel, encoding it once for all of them.
+	//a write that fails was dropped (or disconnected) by the connection's OverflowPolicy, which QueueMonitor counts.
+	pm := NewPreparedMessage(data.message)
+	for _, conn := range subscribers {
+		if data.conn == conn && !ch.policy.Echo {
 			continue
 		}
-		if err := conn.Write(data.message); err != nil {
-			fmt.Println(err) // TODO: do something else here.
-		} else if h.storer != nil {
+		if err := writePrepared(conn, pm); err == nil && persist {
 			h.storer.SentTo(data.conn, conn, data.message)
 		}
 	}
@@ -181,26 +564,59 @@ func (h *MultiPlexHub) writeToChannel(data *hubData) {
 	if h.sisterManager != nil {
 		h.sisterManager.Write(data.message)
 	}
+	if !data.isSister {
+		h.acknowledge(data, nil)
+	}
 }
 
-func (h *MultiPlexHub) connectionCleanup(data *hubData) {
-	for _, channel := range data.conn.Channels() {
-		h.removeConnection(channel, data.conn)
+// acknowledge answers a message from a client that asked for an ack.
+// A nil perr sends an AckOpcode, otherwise a NackOpcode with the reason is sent.
+func (h *MultiPlexHub) acknowledge(data *hubData, perr *ProtocolError) {
+	if data.isSister || data.message.Flags&FlagAckRequested == 0 {
+		return
 	}
+	if perr != nil {
+		data.conn.Write(perr.nackMessage(data.message))
+		return
+	}
+	data.conn.Write(&Message{Opcode: AckOpcode, ChannelName: data.message.ChannelName, Uuid: data.message.Uuid})
 }
 
-func (h *MultiPlexHub) removeConnection(channelName string, c Connection) {
-	connections := h.channels[channelName]
-	for i, conn := range connections {
-		if c == conn {
-			connections = append(connections[:i], connections[i+1:]...)
-			h.channels[channelName] = connections
-			break
+// connectionCleanup removes the connection from the channels the shard owns. Every shard gets the cleanup message.
+func (h *MultiPlexHub) connectionCleanup(shard *hubShard, data *hubData) {
+	for _, channel := range data.conn.Channels() {
+		if IsPattern(channel) {
+			shard.patterns.remove(channel, data.conn)
+		} else {
+			h.removeConnection(shard, channel, data.conn)
 		}
 	}
+	h.dropSisterPresence(shard, data.conn)
+}
+
+// removeConnection unbinds the connection from the channel and tells the observer what happened to the channel.
+func (h *MultiPlexHub) removeConnection(shard *hubShard, channelName string, conn Connection) {
+	removed, destroyed := shard.removeConnection(channelName, conn)
+	if !removed {
+		return
+	}
+	h.announcePresence(shard, LeaveOpcode, channelName, conn)
+	if h.observer == nil {
+		return
+	}
+	h.observer.Unsubscribed(channelName, conn)
+	if destroyed {
+		h.observer.ChannelEmpty(channelName)
+		h.observer.ChannelDestroyed(channelName)
+	}
 }
 
 func (h *MultiPlexHub) serverMessage(data *hubData) {
+	select {
+	case <-h.done:
+		return // like every other message written after Shutdown, it is dropped.
+	default:
+	}
 	if h.serverHandler != nil {
 		h.serverHandler.Process(data.conn, data.message)
 	}
@@ -0,0 +1,119 @@
+package conductor
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// TestHubConcurrentUse has connections bind, write, unbind and Store from their own goroutines at once,
+// while the shards read their channel lists and storage. Run it with -race.
+func TestHubConcurrentUse(t *testing.T) {
+	const workers, rounds, channels = 16, 200, 8
+
+	storer := NewSimpleStorage(workers * rounds)
+	h := NewMultiPlexHub(NewDeDuper(time.Second, time.Second), NewSimpleAuth(), storer, nil, nil)
+	h.SetPresence(func(channelName string) bool { return strings.HasPrefix(channelName, "room.") })
+	go h.RunLoop()
+	defer h.Shutdown(context.Background())
+
+	conns := make([]*MemoryConnection, workers)
+	for i := range conns {
+		conns[i] = NewMemoryConnection(h)
+		h.Connected(conns[i])
+	}
+	var wg sync.WaitGroup
+	for i, conn := range conns {
+		wg.Add(1)
+		go func(i int, conn *MemoryConnection) {
+			defer wg.Done()
+			for r := 0; r < rounds; r++ {
+				channelName := fmt.Sprintf("room.%d", (i+r)%channels)
+				conn.Store(IdentityKey, fmt.Sprintf("user-%d-%d", i, r))
+				conn.Send(&Message{Opcode: BindOpcode, ChannelName: channelName})
+				if r%10 == 0 {
+					conn.Send(&Message{Opcode: BindOpcode, ChannelName: "room.*"})
+				}
+				conn.Send(&Message{Opcode: WriteOpcode, ChannelName: channelName, Body: []byte("x")})
+				if r%10 == 0 {
+					conn.Send(&Message{Opcode: UnbindOpcode, ChannelName: "room.*"})
+				}
+				conn.Send(&Message{Opcode: UnbindOpcode, ChannelName: channelName})
+				conn.Messages()
+			}
+		}(i, conn)
+	}
+	wg.Wait()
+	h.Sync()
+
+	for _, conn := range conns {
+		if channels := conn.Channels(); len(channels) != 0 {
+			t.Fatalf("%s is still bound to %v", conn.ID(), channels)
+		}
+	}
+	for i, shard := range h.shards {
+		if len(shard.channels) != 0 {
+			t.Fatalf("shard %d still has %d channels", i, len(shard.channels))
+		}
+		if !shard.patterns.empty() {
+			t.Fatalf("shard %d still has patterns", i)
+		}
+	}
+	stored := 0
+	for c := 0; c < channels; c++ {
+		messages := storer.Get(fmt.Sprintf("room.%d", c))
+		for j := 1; j < len(messages); j++ {
+			if messages[j].Sequence <= messages[j-1].Sequence {
+				t.Fatalf("room.%d: sequence %d stored after %d", c, messages[j].Sequence, messages[j-1].Sequence)
+			}
+		}
+		stored += len(messages)
+	}
+	if stored != workers*rounds {
+		t.Fatalf("stored %d writes, want %d", stored, workers*rounds)
+	}
+}
+
+// discardConnection is a PreparedWriter that encodes what it is sent, like a websocket connection does, then drops it.
+type discardConnection struct {
+	ConnectionState
+	codec Codec
+}
+
+func (c *discardConnection) ID() string                 { return "discard" }
+func (c *discardConnection) ReadLoop(hub HubConnection) {}
+func (c *discardConnection) Disconnect()                {}
+
+func (c *discardConnection) Write(message *Message) error {
+	return marshalPooled(c.codec, message, func([]byte) error { return nil })
+}
+
+func (c *discardConnection) WritePrepared(pm *PreparedMessage) error {
+	_, err := pm.websocketFrame(c.codec)
+	return err
+}
+
+// BenchmarkBroadcast writes to a channel with more and more subscribers, which should each cost a write but not an encode.
+func BenchmarkBroadcast(b *testing.B) {
+	for _, subscribers := range []int{1, 10, 100, 1000} {
+		b.Run(fmt.Sprint(subscribers), func(b *testing.B) {
+			h := NewMultiPlexHub(nil, nil, nil, nil, nil)
+			shard := h.shards[shardIndex("bench", len(h.shards))]
+			ch, _ := shard.channel("bench")
+			for i := 0; i < subscribers; i++ {
+				ch.add(&discardConnection{codec: &BinaryCodec{}})
+			}
+			sender := &discardConnection{codec: &BinaryCodec{}}
+			body := make([]byte, 128)
+			b.ReportAllocs()
+			b.ResetTimer()
+			for i := 0; i < b.N; i++ {
+				message := &Message{Opcode: WriteOpcode, ChannelName: "bench", Uuid: "bench", Body: body}
+				h.writeToChannel(shard, &hubData{conn: sender, message: message})
+			}
+		})
+	}
+}
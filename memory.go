@@ -0,0 +1,83 @@
+package conductor
+
+import "sync"
+
+// MemoryConnection is a Connection that lives in memory instead of on the network.
+// Messages the hub writes to it wait in its inbox until Messages takes them.
+// They are handed over as is, without being encoded, so they are the same *Message the hub wrote.
+// It is what the conductortest harness uses, but it works for anything that wants to talk to a hub in process.
+type MemoryConnection struct {
+	// the ID of this connection.
+	id string
+
+	// maintain a pointer to the hub.
+	h HubConnection
+
+	// the channel list and local storage of the connection.
+	ConnectionState
+
+	// guards the inbox, which the shards write to from their own goroutines.
+	mu    sync.Mutex
+	inbox []*Message
+
+	// closed once the connection is disconnected.
+	done           chan struct{}
+	disconnectOnce sync.Once
+}
+
+// NewMemoryConnection creates a MemoryConnection that sends its messages to the hub provided.
+// Like with any other connection, tell the hub about it with Connected (if it should be in the registry).
+func NewMemoryConnection(h HubConnection) *MemoryConnection {
+	c := &MemoryConnection{id: newUUID(), h: h, done: make(chan struct{})}
+	c.Store(ConnectionIDKey, c.id)
+	return c
+}
+
+//ID returns the ID of this connection.
+func (c *MemoryConnection) ID() string {
+	return c.id
+}
+
+//Write puts the message in the inbox. It returns ErrConnectionClosed once the connection is disconnected.
+func (c *MemoryConnection) Write(message *Message) error {
+	select {
+	case <-c.done:
+		return ErrConnectionClosed
+	default:
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.inbox = append(c.inbox, message)
+	return nil
+}
+
+//ReadLoop blocks until the connection is disconnected, since the messages to the hub are sent with Send.
+func (c *MemoryConnection) ReadLoop(hub HubConnection) {
+	<-c.done
+}
+
+//Disconnect removes the connection from the hub. Messages written after this are dropped.
+func (c *MemoryConnection) Disconnect() {
+	c.disconnectOnce.Do(func() {
+		c.h.Write(c, NewCleanUpMessage())
+		close(c.done)
+	})
+}
+
+//Send hands the message to the hub, as if the client this connection represents had written it.
+//A message without a Uuid gets one.
+func (c *MemoryConnection) Send(message *Message) {
+	if message.Uuid == "" {
+		message.Uuid = newUUID()
+	}
+	c.h.Write(c, message)
+}
+
+//Messages takes the messages in the inbox, oldest first, leaving it empty.
+func (c *MemoryConnection) Messages() []*Message {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	messages := c.inbox
+	c.inbox = nil
+	return messages
+}
@@ -1,15 +1,15 @@
 package conductor
 
 import (
-	"bytes"
 	"crypto/rand"
 	"encoding/binary"
 	"fmt"
 	"io"
+	"math"
 )
 
 const (
-	BindOpcode              = iota // BindOpcode bind to a channel. This will create the channel if it does not exist.
+	BindOpcode              = iota // BindOpcode bind to a channel. This will create the channel if it does not exist. The channel name can be a pattern, like "orders.*".
 	UnbindOpcode                   // UnbindOpcode unbind from a channel.
 	WriteOpcode                    // WriteOpcode broadcasts on provided channel.
 	ServerOpcode                   // ServerOpcode intend to be between a single client and the server (not broadcasted).
@@ -19,89 +19,307 @@ const (
 	StreamWriteOpcode              // StreamWriteOpcode signifies the write (a chunk) of a file
 	MetaQueryOpcode                // MetaQueryOpcode is for sister servers to query meta data from each other
 	MetaQueryResponseOpcode        // MetaQueryResponseOpcode is to respond to a meta query
+	ErrorOpcode                    // ErrorOpcode is sent back to a client when its message was rejected. The body is a ProtocolError.
+	AckOpcode                      // AckOpcode is sent back to a client when the hub accepted a message that asked for an ack.
+	NackOpcode                     // NackOpcode is sent back to a client when the hub refused a message that asked for an ack. The body is a ProtocolError.
+	JoinOpcode                     // JoinOpcode is broadcast on a channel with presence when a connection binds to it. The body is a Member.
+	LeaveOpcode                    // LeaveOpcode is broadcast on a channel with presence when a connection unbinds or disconnects. The body is a Member.
+	PresenceQueryOpcode            // PresenceQueryOpcode asks for the members of a channel with presence.
+	PresenceResponseOpcode         // PresenceResponseOpcode answers a presence query with the same Uuid. The body is a list of Members.
+	DirectOpcode                   // DirectOpcode sends a message to one connection. The channel name is the connection ID (or identity, see FlagDirectToIdentity).
+)
+
+const (
+	// FlagAckRequested asks the hub to answer a bind, unbind or write with an AckOpcode or NackOpcode.
+	// The answer has the same Uuid as the message it answers. A message with the Uuid of one the hub already handled
+	// is nacked with ErrCodeDuplicate, since the first answer is the one that says how it went.
+	FlagAckRequested = 1 << iota
+
+	// FlagDirectToIdentity addresses a DirectOpcode message to every connection of an identity, instead of a connection ID.
+	FlagDirectToIdentity
+)
+
+const (
+	// LegacyFrameVersion is the original unversioned opcode/uuid/name/body layout.
+	LegacyFrameVersion = 0
+
+	// FrameVersion is the current frame version written by Marshal.
+	FrameVersion = 1
+
+	// frameMagic marks the start of a versioned frame, and the version that follows it is never zero.
+	// A legacy frame starts with its opcode, so it could start with this value too, but the opcode's high byte
+	// comes next and is zero for every opcode below 256. Legacy frames with opcodes that would look versioned
+	// are refused with ErrAmbiguousOpcode, so the two can always be told apart.
+	frameMagic = 0xC0
+
+	// frameSubprotocol is the websocket subprotocol that peers offer to say they understand versioned frames.
+	// Peers that don't offer it are written legacy frames.
+	frameSubprotocol = "conductor.v1"
 )
 
 // Message represents the framing of the messages that get sent back and forth.
 type Message struct {
-	Opcode      uint16 `json:"opcode"`
-	uuidSize    uint16 `json:"uuid_size"`
-	Uuid        string `json:"uuid"`
-	nameSize    uint16 `json:"name_size"`
-	ChannelName string `json:"channel_name"`
-	bodySize    uint32 `json:"body_size"`
-	Body        []byte `json:"body"`
+	Version     uint8             `json:"-"` // Version is the frame version the message was decoded from.
+	Flags       uint16            `json:"flags,omitempty"`
+	Opcode      uint16            `json:"opcode"`
+	Uuid        string            `json:"uuid"`
+	ChannelName string            `json:"channel_name"`
+	Body        []byte            `json:"body"`
+	Headers     map[string]string `json:"headers,omitempty"`   // Headers is application metadata, like a content type or trace ID.
+	Sender      string            `json:"sender,omitempty"`    // Sender is stamped by the server with the identity of the connection that sent the message.
+	Sequence    uint64            `json:"sequence,omitempty"`  // Sequence is stamped by the server. It goes up by one for every write to the channel (zero if nobody there was subscribed).
+	Timestamp   int64             `json:"timestamp,omitempty"` // Timestamp is when the server received the write, in Unix nanoseconds.
+	Extensions  []Extension       `json:"extensions,omitempty"`
+
+	// set on the messages the server makes for itself, like the cleanup of a connection.
+	// No codec decodes it, so a client can never set it.
+	internal bool
 }
 
-//Marshal converts the Message struct into bytes to transmit over a connection.
-func (m *Message) Marshal() ([]byte, error) {
-	buf := new(bytes.Buffer)
-	if err := binary.Write(buf, binary.LittleEndian, m.Opcode); err != nil {
-		return []byte(""), err
+// NewCleanUpMessage creates the message a Connection writes to the hub when it disconnects,
+// so the hub removes it from its channels. Clients can't send a CleanUpOpcode themselves.
+func NewCleanUpMessage() *Message {
+	return &Message{Opcode: CleanUpOpcode, ChannelName: "", internal: true}
+}
+
+// serverOnly reports if the opcode is one only the server or its sisters can send.
+func serverOnly(opcode uint16) bool {
+	return opcode == CleanUpOpcode || opcode == MetaQueryOpcode || opcode == MetaQueryResponseOpcode
+}
+
+const (
+	HeaderContentType   = "content-type"   // HeaderContentType is the media type of the body.
+	HeaderTraceID       = "trace-id"       // HeaderTraceID ties the message to a distributed trace.
+	HeaderCorrelationID = "correlation-id" // HeaderCorrelationID ties a reply to the request it answers.
+)
+
+const (
+	// ExtensionHeaders is the extension type that carries the Headers of a message in a versioned frame.
+	ExtensionHeaders = 1
+
+	// ExtensionSender is the extension type that carries the Sender of a message in a versioned frame.
+	ExtensionSender = 2
+
+	// ExtensionSequence is the extension type that carries the Sequence of a message in a versioned frame.
+	ExtensionSequence = 3
+
+	// ExtensionTimestamp is the extension type that carries the Timestamp of a message in a versioned frame.
+	ExtensionTimestamp = 4
+)
+
+// Extension is a type-length-value field carried at the end of a versioned frame.
+// Peers skip extension types they don't know about, so new fields can be added without breaking older peers.
+// Types below 0x8000 are reserved for conductor, the rest are free for applications to use.
+// Reserved types that map to a field of Message, like ExtensionHeaders, are read from and written to that field instead.
+// A message with one of them in its Extensions can't be written, so the field is never sent twice.
+type Extension struct {
+	Type  uint16 `json:"type"`
+	Value []byte `json:"value"`
+}
+
+// fieldExtension reports if the extension type maps to a field of Message.
+func fieldExtension(extType uint16) bool {
+	return extType >= ExtensionHeaders && extType <= ExtensionTimestamp
+}
+
+// Header returns the value of the header, or an empty string if it isn't set.
+func (m *Message) Header(key string) string {
+	return m.Headers[key]
+}
+
+// SetHeader sets the value of the header.
+func (m *Message) SetHeader(key, value string) {
+	if m.Headers == nil {
+		m.Headers = make(map[string]string)
 	}
+	m.Headers[key] = value
+}
 
-	m.uuidSize = uint16(len(m.Uuid))
-	if err := binary.Write(buf, binary.LittleEndian, m.uuidSize); err != nil {
-		return []byte(""), err
+// Extension returns the value of the first extension with the type provided.
+func (m *Message) Extension(extType uint16) ([]byte, bool) {
+	for _, ext := range m.Extensions {
+		if ext.Type == extType {
+			return ext.Value, true
+		}
 	}
-	if _, err := buf.WriteString(m.Uuid); err != nil {
-		return []byte(""), err
+	return nil, false
+}
+
+// SetExtension adds the extension to the message, replacing any extension of the same type.
+func (m *Message) SetExtension(extType uint16, value []byte) {
+	for i, ext := range m.Extensions {
+		if ext.Type == extType {
+			m.Extensions[i].Value = value
+			return
+		}
 	}
+	m.Extensions = append(m.Extensions, Extension{Type: extType, Value: value})
+}
 
-	m.nameSize = uint16(len(m.ChannelName))
-	if err := binary.Write(buf, binary.LittleEndian, m.nameSize); err != nil {
-		return []byte(""), err
+//Marshal converts the Message struct into bytes to transmit over a connection.
+//It always writes the current FrameVersion.
+func (m *Message) Marshal() ([]byte, error) {
+	return m.MarshalVersion(FrameVersion)
+}
+
+//MarshalVersion converts the Message struct into bytes using the frame layout of the version provided.
+//Flags and extensions are dropped when writing a legacy frame, since that layout has no room for them.
+func (m *Message) MarshalVersion(version uint8) ([]byte, error) {
+	return m.AppendMarshalVersion(make([]byte, 0, m.frameSize(version)), version)
+}
+
+//AppendMarshal appends the current frame version of the message to dst and returns the extended slice.
+//Reusing dst between calls lets the encoding happen without any allocations.
+func (m *Message) AppendMarshal(dst []byte) ([]byte, error) {
+	return m.AppendMarshalVersion(dst, FrameVersion)
+}
+
+//AppendMarshalVersion is like AppendMarshal, but uses the frame layout of the version provided.
+//A field too long for the size in front of it in the frame returns an ErrTooLarge error.
+func (m *Message) AppendMarshalVersion(dst []byte, version uint8) ([]byte, error) {
+	if err := m.checkLengths(version); err != nil {
+		return dst, err
 	}
-	if _, err := buf.WriteString(m.ChannelName); err != nil {
-		return []byte(""), err
+	switch version {
+	case LegacyFrameVersion:
+		if m.Opcode&0xff == frameMagic && m.Opcode>>8 != 0 {
+			return dst, ErrAmbiguousOpcode
+		}
+		dst = binary.LittleEndian.AppendUint16(dst, m.Opcode)
+	case FrameVersion:
+		dst = append(dst, frameMagic, FrameVersion)
+		dst = binary.LittleEndian.AppendUint16(dst, m.Flags)
+		dst = binary.LittleEndian.AppendUint16(dst, m.Opcode)
+	default:
+		return dst, ErrUnsupportedVersion
 	}
 
-	m.bodySize = uint32(len(m.Body))
-	if err := binary.Write(buf, binary.LittleEndian, m.bodySize); err != nil {
-		return []byte(""), err
+	dst = appendString(dst, m.Uuid)
+	dst = appendString(dst, m.ChannelName)
+
+	dst = binary.LittleEndian.AppendUint32(dst, uint32(len(m.Body)))
+	dst = append(dst, m.Body...)
+
+	if version == LegacyFrameVersion {
+		return dst, nil
+	}
+	for _, ext := range m.Extensions {
+		if fieldExtension(ext.Type) {
+			return dst, ErrFieldExtension
+		}
+		dst = binary.LittleEndian.AppendUint16(dst, ext.Type)
+		dst = binary.LittleEndian.AppendUint32(dst, uint32(len(ext.Value)))
+		dst = append(dst, ext.Value...)
 	}
-	if _, err := buf.Write(m.Body); err != nil {
-		return []byte(""), err
+	if len(m.Headers) > 0 {
+		dst = binary.LittleEndian.AppendUint16(dst, ExtensionHeaders)
+		dst = binary.LittleEndian.AppendUint32(dst, uint32(headersSize(m.Headers)))
+		dst = binary.LittleEndian.AppendUint16(dst, uint16(len(m.Headers)))
+		for k, v := range m.Headers {
+			dst = appendString(dst, k)
+			dst = appendString(dst, v)
+		}
+	}
+	if m.Sender != "" {
+		dst = binary.LittleEndian.AppendUint16(dst, ExtensionSender)
+		dst = binary.LittleEndian.AppendUint32(dst, uint32(len(m.Sender)))
+		dst = append(dst, m.Sender...)
+	}
+	if m.Sequence != 0 {
+		dst = binary.LittleEndian.AppendUint16(dst, ExtensionSequence)
+		dst = binary.LittleEndian.AppendUint32(dst, 8)
+		dst = binary.LittleEndian.AppendUint64(dst, m.Sequence)
+	}
+	if m.Timestamp != 0 {
+		dst = binary.LittleEndian.AppendUint16(dst, ExtensionTimestamp)
+		dst = binary.LittleEndian.AppendUint32(dst, 8)
+		dst = binary.LittleEndian.AppendUint64(dst, uint64(m.Timestamp))
 	}
 
-	return buf.Bytes(), nil
+	return dst, nil
 }
 
-//Unmarshal converts a slice of bytes into a Message struct.
-func Unmarshal(b []byte) (*Message, error) {
-	var m Message
-	buf := bytes.NewBuffer(b)
-	if err := binary.Read(buf, binary.LittleEndian, &m.Opcode); err != nil {
-		return nil, err
+// checkLengths returns an ErrTooLarge error if a field is too long for the size in front of it in the frame layout
+// of the version provided, since the size would wrap around and the frame couldn't be read back.
+func (m *Message) checkLengths(version uint8) error {
+	if len(m.Uuid) > math.MaxUint16 {
+		return tooLarge("uuid")
 	}
-
-	var err error
-	if m.Uuid, m.uuidSize, err = readString(buf); err != nil {
-		return nil, err
+	if len(m.ChannelName) > math.MaxUint16 {
+		return tooLarge("channel name")
 	}
-
-	if m.ChannelName, m.nameSize, err = readString(buf); err != nil {
-		return nil, err
+	if uint64(len(m.Body)) > math.MaxUint32 {
+		return tooLarge("body")
 	}
-
-	if err := binary.Read(buf, binary.LittleEndian, &m.bodySize); err != nil {
-		return nil, err
+	if version == LegacyFrameVersion {
+		return nil
+	}
+	for _, ext := range m.Extensions {
+		if uint64(len(ext.Value)) > math.MaxUint32 {
+			return tooLarge("extension")
+		}
+	}
+	if len(m.Headers) > math.MaxUint16 {
+		return tooLarge("headers")
+	}
+	for k, v := range m.Headers {
+		if len(k) > math.MaxUint16 {
+			return tooLarge("header key")
+		}
+		if len(v) > math.MaxUint16 {
+			return tooLarge("header value")
+		}
 	}
+	if len(m.Headers) > 0 && uint64(headersSize(m.Headers)) > math.MaxUint32 {
+		return tooLarge("headers")
+	}
+	if uint64(len(m.Sender)) > math.MaxUint32 {
+		return tooLarge("sender")
+	}
+	return nil
+}
 
-	str := make([]byte, m.bodySize)
-	buf.Read(str)
-	m.Body = str
+func tooLarge(field string) error {
+	return fmt.Errorf("%w: %s", ErrTooLarge, field)
+}
 
-	return &m, nil
+// frameSize returns how many bytes the message takes up in the frame layout of the version provided.
+func (m *Message) frameSize(version uint8) int {
+	size := 2 + 2 + len(m.Uuid) + 2 + len(m.ChannelName) + 4 + len(m.Body)
+	if version == LegacyFrameVersion {
+		return size
+	}
+	size += 4
+	for _, ext := range m.Extensions {
+		size += 2 + 4 + len(ext.Value)
+	}
+	if len(m.Headers) > 0 {
+		size += 2 + 4 + headersSize(m.Headers)
+	}
+	if m.Sender != "" {
+		size += 2 + 4 + len(m.Sender)
+	}
+	if m.Sequence != 0 {
+		size += 2 + 4 + 8
+	}
+	if m.Timestamp != 0 {
+		size += 2 + 4 + 8
+	}
+	return size
 }
 
-func readString(buf *bytes.Buffer) (string, uint16, error) {
-	var size uint16
-	if err := binary.Read(buf, binary.LittleEndian, &size); err != nil {
-		return "", 0, err
+// headersSize returns the size of the value of the headers extension.
+func headersSize(headers map[string]string) int {
+	size := 2
+	for k, v := range headers {
+		size += 2 + len(k) + 2 + len(v)
 	}
-	str := make([]byte, size)
-	buf.Read(str)
-	return string(str), size, nil
+	return size
+}
+
+func appendString(dst []byte, str string) []byte {
+	dst = binary.LittleEndian.AppendUint16(dst, uint16(len(str)))
+	return append(dst, str...)
 }
 
 // newUUID generates a random UUID according to RFC 4122
@@ -0,0 +1,110 @@
+package conductor
+
+import (
+	"errors"
+	"fmt"
+	"reflect"
+	"testing"
+)
+
+func TestMarshalRoundTrip(t *testing.T) {
+	m := &Message{Flags: FlagAckRequested, Opcode: WriteOpcode, Uuid: newUUID(), ChannelName: "chat", Body: []byte("hi"),
+		Headers: map[string]string{HeaderTraceID: "t1"}, Sender: "alice", Sequence: 7, Timestamp: 1234,
+		Extensions: []Extension{{Type: 0x9000, Value: []byte("x")}}}
+	b, err := m.Marshal()
+	if err != nil {
+		t.Fatal(err)
+	}
+	got, err := Unmarshal(b)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := *m
+	want.Version = FrameVersion
+	if !reflect.DeepEqual(got, &want) {
+		t.Fatalf("got %+v, want %+v", got, &want)
+	}
+
+	// a legacy frame only has the opcode, uuid, channel name and body.
+	b, err = m.MarshalVersion(LegacyFrameVersion)
+	if err != nil {
+		t.Fatal(err)
+	}
+	got, err = Unmarshal(b)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want = Message{Opcode: m.Opcode, Uuid: m.Uuid, ChannelName: m.ChannelName, Body: m.Body}
+	if !reflect.DeepEqual(got, &want) {
+		t.Fatalf("got %+v, want %+v", got, &want)
+	}
+}
+
+// TestLegacyOpcodeWithMagic checks a legacy frame whose opcode starts with the magic isn't read as a versioned frame,
+// and that the opcodes that would be are refused.
+func TestLegacyOpcodeWithMagic(t *testing.T) {
+	m := &Message{Opcode: frameMagic, Uuid: "u", ChannelName: "c", Body: []byte("b")}
+	b, err := m.MarshalVersion(LegacyFrameVersion)
+	if err != nil {
+		t.Fatal(err)
+	}
+	got, err := Unmarshal(b)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got.Version != LegacyFrameVersion || got.Opcode != frameMagic || string(got.Body) != "b" {
+		t.Fatalf("decoded %+v", got)
+	}
+	for _, opcode := range []uint16{0x01C0, 0xFFC0} {
+		if _, err := (&Message{Opcode: opcode}).MarshalVersion(LegacyFrameVersion); err != ErrAmbiguousOpcode {
+			t.Fatalf("opcode %#x: %v", opcode, err)
+		}
+		m := &Message{Opcode: opcode, Uuid: "u", ChannelName: "c"}
+		b, err := m.Marshal()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got, err := Unmarshal(b); err != nil || got.Opcode != opcode {
+			t.Fatalf("opcode %#x in a versioned frame: %v %v", opcode, got, err)
+		}
+	}
+}
+
+// TestMarshalTooLarge checks fields too long for the size in front of them are refused instead of wrapping around.
+func TestMarshalTooLarge(t *testing.T) {
+	long := string(make([]byte, 1<<16))
+	manyHeaders := make(map[string]string, 1<<16)
+	for i := 0; i < 1<<16; i++ {
+		manyHeaders[fmt.Sprint(i)] = ""
+	}
+	tests := []struct {
+		name    string
+		message Message
+		legacy  bool
+	}{
+		{name: "uuid", message: Message{Uuid: long}, legacy: true},
+		{name: "channel name", message: Message{ChannelName: long}, legacy: true},
+		{name: "header key", message: Message{Headers: map[string]string{long: "v"}}},
+		{name: "header value", message: Message{Headers: map[string]string{"k": long}}},
+		{name: "header count", message: Message{Headers: manyHeaders}},
+	}
+	for _, tt := range tests {
+		versions := []uint8{FrameVersion}
+		if tt.legacy {
+			versions = append(versions, LegacyFrameVersion)
+		}
+		for _, version := range versions {
+			if _, err := tt.message.MarshalVersion(version); !errors.Is(err, ErrTooLarge) {
+				t.Fatalf("%s in version %d: %v", tt.name, version, err)
+			}
+		}
+	}
+	ok := Message{Uuid: long[1:], ChannelName: long[1:], Headers: map[string]string{long[1:]: long[1:]}}
+	b, err := ok.Marshal()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := UnmarshalLimits(b, DecodeLimits{}); err != nil {
+		t.Fatal(err)
+	}
+}
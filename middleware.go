@@ -0,0 +1,39 @@
+package conductor
+
+// HandlerFunc handles a message on its way into the hub. fromSister is true for messages from sister servers.
+type HandlerFunc func(conn Connection, message *Message, fromSister bool)
+
+// Middleware wraps the handler of the messages coming into the hub. It runs after a message is validated,
+// stamped with its sender and deduped, but before it is handed to the shard that processes it. Only messages from
+// clients and sisters go through it. The ones the server makes for itself, like the cleanup of a connection, don't.
+// A middleware can look at or change the message and then call next, drop the message by not calling next,
+// or fan it out by calling next more than once. Fanned out messages should be copies with their own Uuid,
+// otherwise the deduper of a sister server drops all but the first. The hub owns a message once next is called,
+// so make any copies before that. next has to be called before the middleware returns: a message that asked for
+// an ack and wasn't passed on by then is nacked with ErrCodeDropped.
+// Middleware runs on the goroutine of the connection that sent the message, so it has to be safe for concurrent use.
+type Middleware func(next HandlerFunc) HandlerFunc
+
+// OpcodeMiddleware only runs the middleware for messages with one of the opcodes. The rest go straight to next.
+func OpcodeMiddleware(middleware Middleware, opcodes ...uint16) Middleware {
+	return func(next HandlerFunc) HandlerFunc {
+		wrapped := middleware(next)
+		return func(conn Connection, message *Message, fromSister bool) {
+			for _, opcode := range opcodes {
+				if message.Opcode == opcode {
+					wrapped(conn, message, fromSister)
+					return
+				}
+			}
+			next(conn, message, fromSister)
+		}
+	}
+}
+
+// chain wraps the handler with the middleware, so the first middleware is the first one to see a message.
+func chain(handler HandlerFunc, middleware []Middleware) HandlerFunc {
+	for i := len(middleware) - 1; i >= 0; i-- {
+		handler = middleware[i](handler)
+	}
+	return handler
+}
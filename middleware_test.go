@@ -0,0 +1,37 @@
+package conductor
+
+import (
+	"context"
+	"testing"
+)
+
+// TestMiddlewareSkipsInternalMessages checks a middleware that drops what it doesn't know can't stop
+// the hub from cleaning up after a connection that disconnected.
+func TestMiddlewareSkipsInternalMessages(t *testing.T) {
+	h := NewMultiPlexHub(nil, nil, nil, nil, nil)
+	var seen []uint16
+	h.Use(func(next HandlerFunc) HandlerFunc {
+		return func(conn Connection, message *Message, fromSister bool) {
+			seen = append(seen, message.Opcode)
+			if message.Opcode == BindOpcode {
+				next(conn, message, fromSister)
+			}
+		}
+	})
+	go h.RunLoop()
+	defer h.Shutdown(context.Background())
+
+	conn := NewMemoryConnection(h)
+	conn.Send(&Message{Opcode: BindOpcode, ChannelName: "chat"})
+	h.Sync()
+	conn.Disconnect()
+	h.Sync()
+	for i, shard := range h.shards {
+		if len(shard.channels) != 0 {
+			t.Fatalf("shard %d still has the connection bound", i)
+		}
+	}
+	if len(seen) != 1 || seen[0] != BindOpcode {
+		t.Fatalf("middleware saw %v", seen)
+	}
+}
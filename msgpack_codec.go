@@ -0,0 +1,45 @@
+package conductor
+
+import (
+	"bytes"
+
+	"github.com/gorilla/websocket"
+	"github.com/vmihailenco/msgpack/v5"
+)
+
+// MsgPackCodec sends each message as a MessagePack map in a binary frame.
+// The map keys are the same as the JSON struct tags on Message.
+type MsgPackCodec struct {
+}
+
+// Name returns the subprotocol of MessagePack frames.
+func (c *MsgPackCodec) Name() string {
+	return "conductor.msgpack"
+}
+
+// FrameType sends binary frames.
+func (c *MsgPackCodec) FrameType() int {
+	return websocket.BinaryMessage
+}
+
+// Marshal encodes the message as MessagePack.
+func (c *MsgPackCodec) Marshal(message *Message) ([]byte, error) {
+	var buf bytes.Buffer
+	enc := msgpack.NewEncoder(&buf)
+	enc.SetCustomStructTag("json")
+	if err := enc.Encode(message); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+// Unmarshal decodes a MessagePack message.
+func (c *MsgPackCodec) Unmarshal(b []byte) (*Message, error) {
+	var m Message
+	dec := msgpack.NewDecoder(bytes.NewReader(b))
+	dec.SetCustomStructTag("json")
+	if err := dec.Decode(&m); err != nil {
+		return nil, err
+	}
+	return &m, nil
+}
@@ -0,0 +1,14 @@
+package conductor
+
+// ChannelObserver is the based interface for being notified about the life of a channel.
+// A channel is created when the first connection binds to it and destroyed as soon as it is empty,
+// so starting and stopping per channel work (like a room worker) can hang off these calls.
+// Calls for a channel are made in order from the goroutine of the shard that owns it, but calls for different
+// channels can come at the same time. The shard waits on the calls, so keep them quick.
+type ChannelObserver interface {
+	ChannelCreated(channelName string)                // the first connection is binding to the channel.
+	Subscribed(channelName string, conn Connection)   // the connection bound to the channel.
+	Unsubscribed(channelName string, conn Connection) // the connection unbound from the channel (or disconnected).
+	ChannelEmpty(channelName string)                  // the last connection left the channel.
+	ChannelDestroyed(channelName string)              // the channel was removed from the hub, right after it became empty.
+}
@@ -0,0 +1,102 @@
+package conductor
+
+import "time"
+
+const (
+	// Time allowed to write a message to the peer.
+	defaultWriteWait = 10 * time.Second
+
+	// Time allowed to read the next pong message from the peer.
+	defaultPongWait = 60 * time.Second
+
+	// Send pings to peer with this period. Must be less than pongWait.
+	defaultPingPeriod = (defaultPongWait * 9) / 10
+
+	// Maximum message size allowed from peer.
+	defaultMaxMessageSize = 512 * 500
+
+	// Maximum channel name size allowed from peer.
+	defaultMaxChannelNameSize = 255
+
+	// The size of the websocket read and write buffers.
+	defaultBufferSize = 1024
+
+	// How long a long-poll waits for messages. Proxies tend to cut requests off after 30 seconds.
+	defaultPollTimeout = 25 * time.Second
+)
+
+// ServerOptions are the limits and timeouts of the connections of a Server, both clients and sisters.
+// A zero field uses the default from DefaultServerOptions.
+type ServerOptions struct {
+	WriteWait       time.Duration  // WriteWait is how long a write to a connection can take before the connection is dropped.
+	PongWait        time.Duration  // PongWait is how long a connection can go without a pong before it is dropped.
+	PingPeriod      time.Duration  // PingPeriod is how often connections are pinged. It has to be less than PongWait.
+	MaxMessageSize  int64          // MaxMessageSize is the biggest frame a connection can send, in bytes.
+	ReadBufferSize  int            // ReadBufferSize is the size of the websocket read buffer, in bytes.
+	WriteBufferSize int            // WriteBufferSize is the size of the websocket write buffer, in bytes.
+	QueueSize       int            // QueueSize is how many messages can wait to be written to each connection.
+	OverflowPolicy  OverflowPolicy // OverflowPolicy decides what happens when a connection's queue is full.
+	PollTimeout     time.Duration  // PollTimeout is how long a long-poll request waits for messages before it returns empty.
+
+	// SisterOverflowPolicy decides what happens when the queue of a sister connection is full. A sister that drops
+	// messages leaves its clients missing writes without anyone knowing, so sisters can't use DropOldest:
+	// the zero value means DisconnectSlowConsumer, which is the default.
+	SisterOverflowPolicy OverflowPolicy
+}
+
+// DefaultServerOptions returns the options a Server uses unless they are changed.
+func DefaultServerOptions() ServerOptions {
+	return ServerOptions{
+		WriteWait:       defaultWriteWait,
+		PongWait:        defaultPongWait,
+		PingPeriod:      defaultPingPeriod,
+		MaxMessageSize:  defaultMaxMessageSize,
+		ReadBufferSize:  defaultBufferSize,
+		WriteBufferSize: defaultBufferSize,
+		QueueSize:       defaultQueueSize,
+		OverflowPolicy:  DropOldest,
+		PollTimeout:     defaultPollTimeout,
+
+		SisterOverflowPolicy: DisconnectSlowConsumer,
+	}
+}
+
+// withDefaults fills in the zero fields, and makes sure pings go out before the pong wait is up.
+func (o ServerOptions) withDefaults() ServerOptions {
+	defaults := DefaultServerOptions()
+	if o.WriteWait <= 0 {
+		o.WriteWait = defaults.WriteWait
+	}
+	if o.PongWait <= 0 {
+		o.PongWait = defaults.PongWait
+	}
+	if o.PingPeriod <= 0 || o.PingPeriod >= o.PongWait {
+		o.PingPeriod = (o.PongWait * 9) / 10
+	}
+	if o.MaxMessageSize <= 0 {
+		o.MaxMessageSize = defaults.MaxMessageSize
+	}
+	if o.ReadBufferSize <= 0 {
+		o.ReadBufferSize = defaults.ReadBufferSize
+	}
+	if o.WriteBufferSize <= 0 {
+		o.WriteBufferSize = defaults.WriteBufferSize
+	}
+	if o.QueueSize <= 0 {
+		o.QueueSize = defaults.QueueSize
+	}
+	if o.PollTimeout <= 0 {
+		o.PollTimeout = defaults.PollTimeout
+	}
+	if o.SisterOverflowPolicy == DropOldest {
+		o.SisterOverflowPolicy = defaults.SisterOverflowPolicy
+	}
+	return o
+}
+
+// decodeLimits returns the DefaultDecodeLimits, with the body allowed to be as big as a frame.
+func (o ServerOptions) decodeLimits() DecodeLimits {
+	limits := DefaultDecodeLimits
+	limits.MaxBodySize = int(o.MaxMessageSize)
+	return limits
+}
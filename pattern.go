@@ -0,0 +1,136 @@
+package conductor
+
+import "strings"
+
+// Channel names are split into tokens on dots, like "orders.eu.42".
+// A pattern is a channel name with wildcard tokens, which can be bound to (but not written to):
+// "*" matches exactly one token ("orders.*" matches "orders.eu" but not "orders.eu.42")
+// and ">" matches one or more tokens at the end ("tenant.42.>" matches "tenant.42.a" and "tenant.42.a.b").
+const (
+	channelSeparator = "."
+	singleWildcard   = "*"
+	restWildcard     = ">"
+)
+
+// IsPattern checks if the channel name has a wildcard token.
+func IsPattern(channelName string) bool {
+	for _, token := range strings.Split(channelName, channelSeparator) {
+		if token == singleWildcard || token == restWildcard {
+			return true
+		}
+	}
+	return false
+}
+
+// MatchChannel checks if the channel name matches the pattern. A pattern without wildcards only matches itself,
+// so this can be used to check a channel name against a list of bound channels and patterns (like SimpleAuth does).
+func MatchChannel(pattern, channelName string) bool {
+	if pattern == channelName {
+		return true
+	}
+	patternTokens := strings.Split(pattern, channelSeparator)
+	tokens := strings.Split(channelName, channelSeparator)
+	for i, token := range patternTokens {
+		if token == restWildcard {
+			return i == len(patternTokens)-1 && i < len(tokens)
+		}
+		if i >= len(tokens) || (token != singleWildcard && token != tokens[i]) {
+			return false
+		}
+	}
+	return len(patternTokens) == len(tokens)
+}
+
+// validPattern checks the pattern doesn't have empty tokens and only has ">" as the last token.
+func validPattern(pattern string) bool {
+	tokens := strings.Split(pattern, channelSeparator)
+	for i, token := range tokens {
+		if token == "" || (token == restWildcard && i != len(tokens)-1) {
+			return false
+		}
+	}
+	return true
+}
+
+// subscriptionTrie holds the pattern subscriptions of a shard, so a channel name is matched against
+// all of them by walking its tokens once instead of checking every pattern.
+type subscriptionTrie struct {
+	root trieNode
+}
+
+type trieNode struct {
+	// the next token of the patterns going through this node, wildcards included.
+	children map[string]*trieNode
+
+	// the connections bound to the pattern ending at this node.
+	connections []Connection
+}
+
+// empty checks if there are any pattern subscriptions at all.
+func (t *subscriptionTrie) empty() bool {
+	return len(t.root.children) == 0
+}
+
+// add subscribes the connection to the pattern.
+func (t *subscriptionTrie) add(pattern string, conn Connection) {
+	node := &t.root
+	for _, token := range strings.Split(pattern, channelSeparator) {
+		child, ok := node.children[token]
+		if !ok {
+			if node.children == nil {
+				node.children = make(map[string]*trieNode)
+			}
+			child = &trieNode{}
+			node.children[token] = child
+		}
+		node = child
+	}
+	node.connections = append(node.connections, conn)
+}
+
+// remove unsubscribes the connection from the pattern, pruning the nodes nothing goes through anymore.
+func (t *subscriptionTrie) remove(pattern string, conn Connection) {
+	t.root.remove(strings.Split(pattern, channelSeparator), conn)
+}
+
+func (n *trieNode) remove(tokens []string, conn Connection) {
+	if len(tokens) == 0 {
+		for i, c := range n.connections {
+			if c == conn {
+				n.connections = append(n.connections[:i], n.connections[i+1:]...)
+				break
+			}
+		}
+		return
+	}
+	child, ok := n.children[tokens[0]]
+	if !ok {
+		return
+	}
+	child.remove(tokens[1:], conn)
+	if len(child.connections) == 0 && len(child.children) == 0 {
+		delete(n.children, tokens[0])
+	}
+}
+
+// match appends the connections bound to a pattern that matches the channel name.
+// A connection bound to several matching patterns is appended more than once.
+func (t *subscriptionTrie) match(channelName string, conns []Connection) []Connection {
+	return t.root.match(strings.Split(channelName, channelSeparator), conns)
+}
+
+func (n *trieNode) match(tokens []string, conns []Connection) []Connection {
+	if len(tokens) == 0 {
+		return append(conns, n.connections...)
+	}
+	if child, ok := n.children[restWildcard]; ok {
+		conns = append(conns, child.connections...)
+	}
+	if child, ok := n.children[singleWildcard]; ok {
+		conns = child.match(tokens[1:], conns)
+	}
+	if child, ok := n.children[tokens[0]]; ok {
+		conns = child.match(tokens[1:], conns)
+	}
+	return conns
+}
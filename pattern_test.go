@@ -0,0 +1,117 @@
+package conductor
+
+import "testing"
+
+func TestMatchChannel(t *testing.T) {
+	tests := []struct {
+		pattern, channelName string
+		match                bool
+	}{
+		{"orders", "orders", true},
+		{"orders", "orders.eu", false},
+		{"orders.*", "orders.eu", true},
+		{"orders.*", "orders", false},
+		{"orders.*", "orders.eu.42", false},
+		{"*.eu", "orders.eu", true},
+		{"*.eu", "orders.us", false},
+		{"orders.*.42", "orders.eu.42", true},
+		{"orders.*.42", "orders.eu.43", false},
+		{"*.*", "a.b", true},
+		{"*", "a.b", false},
+		{"tenant.>", "tenant.42", true},
+		{"tenant.>", "tenant.42.a.b", true},
+		{"tenant.>", "tenant", false}, // > needs at least one token.
+		{"tenant.>", "other.42", false},
+		{">", "a", true},
+		{">", "a.b.c", true},
+		{"*.>", "a", false},
+		{"*.>", "a.b", true},
+		{"tenant.*.>", "tenant.42.a", true},
+		{"tenant.*.>", "tenant.42", false},
+	}
+	for _, tt := range tests {
+		if got := MatchChannel(tt.pattern, tt.channelName); got != tt.match {
+			t.Errorf("MatchChannel(%q, %q) = %v", tt.pattern, tt.channelName, got)
+		}
+	}
+}
+
+func TestValidPattern(t *testing.T) {
+	for pattern, valid := range map[string]bool{
+		"orders.*":   true,
+		"orders.>":   true,
+		"*.eu.>":     true,
+		">":          true,
+		"orders.>.a": false, // > has to be last.
+		"orders..*":  false,
+		".orders":    false,
+		"orders.":    false,
+		"":           false,
+	} {
+		if validPattern(pattern) != valid {
+			t.Errorf("validPattern(%q) = %v", pattern, !valid)
+		}
+	}
+	if IsPattern("orders.eu") || !IsPattern("orders.*") || !IsPattern("orders.>") || IsPattern("orders.a*") {
+		t.Error("IsPattern")
+	}
+}
+
+// TestSubscriptionTrie checks the trie matches the same connections MatchChannel does, and prunes what it doesn't need.
+func TestSubscriptionTrie(t *testing.T) {
+	patterns := []string{"orders.*", "orders.>", "*.eu", "orders.*.42", "tenant.>", ">", "orders.eu"}
+	conns := make(map[string]Connection, len(patterns))
+	var trie subscriptionTrie
+	for _, pattern := range patterns {
+		conns[pattern] = &discardConnection{}
+		trie.add(pattern, conns[pattern])
+	}
+	for _, channelName := range []string{"orders", "orders.eu", "orders.eu.42", "orders.us.43", "tenant", "tenant.1.2", "x.eu"} {
+		matched := make(map[Connection]int)
+		for _, conn := range trie.match(channelName, nil) {
+			matched[conn]++
+		}
+		for _, pattern := range patterns {
+			want := 0
+			if MatchChannel(pattern, channelName) {
+				want = 1
+			}
+			if matched[conns[pattern]] != want {
+				t.Errorf("%q matched %q %d times, want %d", pattern, channelName, matched[conns[pattern]], want)
+			}
+		}
+	}
+
+	// two connections on the same pattern share a node, which stays until both are gone.
+	other := &discardConnection{}
+	trie.add("orders.*.42", other)
+	trie.remove("orders.*.42", conns["orders.*.42"])
+	if got := trie.match("orders.eu.42", nil); !containsConnection(got, other) || containsConnection(got, conns["orders.*.42"]) {
+		t.Fatal("removed the wrong connection")
+	}
+	trie.remove("orders.*.42", other)
+	if _, ok := trie.root.children["orders"].children["*"].children["42"]; ok {
+		t.Fatal("empty node wasn't pruned")
+	}
+	if _, ok := trie.root.children["orders"].children["*"]; !ok {
+		t.Fatal("pruned a node orders.* still uses")
+	}
+	trie.remove("orders.missing.pattern", other) // removing what isn't there is a no-op.
+	for _, pattern := range patterns {
+		if pattern != "orders.*.42" {
+			trie.remove(pattern, conns[pattern])
+		}
+	}
+	if !trie.empty() {
+		t.Fatalf("trie isn't empty: %v", trie.root.children)
+	}
+}
+
+func containsConnection(conns []Connection, conn Connection) bool {
+	for _, c := range conns {
+		if c == conn {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,63 @@
+package conductor
+
+import "sync"
+
+// ChannelPolicy is how a channel behaves. The hub gets it from the ChannelPolicyProvider when the channel is created.
+type ChannelPolicy struct {
+	MaxSubscribers int  // MaxSubscribers is the most connections that can bind to the channel (zero is no limit).
+	Echo           bool // Echo sends writes back to the connection that wrote them too.
+	Persist        bool // Persist hands writes to the Storage.
+	Private        bool // Private channels need the auther to implement PrivateChannelAuth to bind, don't match pattern subscriptions, and only their members can query their presence.
+}
+
+// DefaultChannelPolicy is the policy of channels when no provider is set, or the provider doesn't match them.
+var DefaultChannelPolicy = ChannelPolicy{Persist: true}
+
+// ChannelPolicyProvider is the based interface for deciding how each channel behaves.
+// It is called from several goroutines at once, so it has to be safe for concurrent use.
+type ChannelPolicyProvider interface {
+	Policy(channelName string) ChannelPolicy // Policy is called when a channel is created.
+}
+
+// PatternPolicyProvider is the default implementation of ChannelPolicyProvider.
+// It matches the channel name against patterns (see MatchChannel) in the order they were added.
+type PatternPolicyProvider struct {
+	mu       sync.RWMutex
+	patterns []string
+	policies []ChannelPolicy
+	fallback ChannelPolicy
+}
+
+// NewPatternPolicyProvider creates a PatternPolicyProvider to use.
+// fallback is the policy of channels that don't match any pattern. DefaultChannelPolicy is an easy default.
+func NewPatternPolicyProvider(fallback ChannelPolicy) *PatternPolicyProvider {
+	return &PatternPolicyProvider{fallback: fallback}
+}
+
+// Add sets the policy of the channels matching the pattern. Patterns added first win.
+func (p *PatternPolicyProvider) Add(pattern string, policy ChannelPolicy) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.patterns = append(p.patterns, pattern)
+	p.policies = append(p.policies, policy)
+}
+
+// Policy returns the policy of the first pattern the channel matches.
+func (p *PatternPolicyProvider) Policy(channelName string) ChannelPolicy {
+	p.mu.RLock()
+	defer p.mu.RUnlock()
+	for i, pattern := range p.patterns {
+		if MatchChannel(pattern, channelName) {
+			return p.policies[i]
+		}
+	}
+	return p.fallback
+}
+
+// channelPolicy returns the policy of a channel that is being created.
+func (h *MultiPlexHub) channelPolicy(channelName string) ChannelPolicy {
+	if h.policies == nil {
+		return DefaultChannelPolicy
+	}
+	return h.policies.Policy(channelName)
+}
@@ -0,0 +1,134 @@
+package conductor
+
+import (
+	"sync"
+
+	"github.com/gorilla/websocket"
+)
+
+// AppendCodec is implemented by codecs that can encode into a buffer they are handed.
+// Connections use it to encode into pooled buffers instead of allocating a new one for every write.
+type AppendCodec interface {
+	AppendMarshal(dst []byte, message *Message) ([]byte, error) // AppendMarshal appends the encoded message to dst and returns the extended slice.
+}
+
+// PreparedWriter is implemented by connections that can send a PreparedMessage.
+// The hub uses it when broadcasting, so a message is encoded once instead of once per subscriber.
+type PreparedWriter interface {
+	WritePrepared(pm *PreparedMessage) error // WritePrepared sends the prepared message to the client this connection represents.
+}
+
+// maxPooledBufferSize keeps the odd huge message from pinning a huge buffer in the pool.
+const maxPooledBufferSize = 64 * 1024
+
+// bufferPool holds the buffers messages are encoded into before they are written.
+var bufferPool = sync.Pool{
+	New: func() interface{} {
+		b := make([]byte, 0, bufferSize)
+		return &b
+	},
+}
+
+// encodeError is returned by marshalPooled when the codec failed, so it can be told apart from write failing.
+type encodeError struct {
+	err error
+}
+
+func (e *encodeError) Error() string {
+	return e.err.Error()
+}
+
+func (e *encodeError) Unwrap() error {
+	return e.err
+}
+
+// marshalPooled encodes the message into a pooled buffer and hands it to write.
+// The buffer goes back into the pool once write returns, so write must not hold onto it.
+// If the codec fails, the error is an *encodeError.
+func marshalPooled(codec Codec, message *Message, write func([]byte) error) error {
+	ac, ok := codec.(AppendCodec)
+	if !ok {
+		buf, err := codec.Marshal(message)
+		if err != nil {
+			return &encodeError{err: err}
+		}
+		return write(buf)
+	}
+	bp := bufferPool.Get().(*[]byte)
+	buf, err := ac.AppendMarshal((*bp)[:0], message)
+	if err != nil {
+		err = &encodeError{err: err}
+	} else {
+		err = write(buf)
+	}
+	if cap(buf) <= maxPooledBufferSize {
+		*bp = buf[:0]
+		bufferPool.Put(bp)
+	}
+	return err
+}
+
+// PreparedMessage caches the encodings of a message.
+// Each codec encodes the message at most once, no matter how many connections it is written to.
+// The message must not be changed after it has been prepared.
+type PreparedMessage struct {
+	Message *Message
+
+	mu      sync.Mutex
+	frames  map[string]*websocket.PreparedMessage
+	encoded map[string][]byte
+}
+
+// NewPreparedMessage creates a PreparedMessage for the message.
+func NewPreparedMessage(message *Message) *PreparedMessage {
+	return &PreparedMessage{Message: message}
+}
+
+// websocketFrame returns the websocket frame of the message for the codec, encoding it on first use.
+func (pm *PreparedMessage) websocketFrame(codec Codec) (*websocket.PreparedMessage, error) {
+	pm.mu.Lock()
+	defer pm.mu.Unlock()
+	if frame, ok := pm.frames[codec.Name()]; ok {
+		return frame, nil
+	}
+	buf, err := codec.Marshal(pm.Message)
+	if err != nil {
+		return nil, err
+	}
+	frame, err := websocket.NewPreparedMessage(codec.FrameType(), buf)
+	if err != nil {
+		return nil, err
+	}
+	if pm.frames == nil {
+		pm.frames = make(map[string]*websocket.PreparedMessage)
+	}
+	pm.frames[codec.Name()] = frame
+	return frame, nil
+}
+
+// encoding returns the message encoded with the codec, encoding it on first use.
+// Raw TCP connections write it as the payload of a frame.
+func (pm *PreparedMessage) encoding(codec Codec) ([]byte, error) {
+	pm.mu.Lock()
+	defer pm.mu.Unlock()
+	if buf, ok := pm.encoded[codec.Name()]; ok {
+		return buf, nil
+	}
+	buf, err := codec.Marshal(pm.Message)
+	if err != nil {
+		return nil, err
+	}
+	if pm.encoded == nil {
+		pm.encoded = make(map[string][]byte)
+	}
+	pm.encoded[codec.Name()] = buf
+	return buf, nil
+}
+
+// writePrepared sends the prepared message on the connection, encoding it once if the connection supports it.
+func writePrepared(conn Connection, pm *PreparedMessage) error {
+	if pw, ok := conn.(PreparedWriter); ok {
+		return pw.WritePrepared(pm)
+	}
+	return conn.Write(pm.Message)
+}
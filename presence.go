@@ -0,0 +1,180 @@
+package conductor
+
+import "encoding/json"
+
+// PresenceFilter decides which channels have presence. Channels it returns true for get a JoinOpcode and LeaveOpcode
+// message when a connection binds and unbinds, and answer PresenceQueryOpcode messages with their members.
+// It is called from several goroutines at once, so it has to be safe for concurrent use.
+type PresenceFilter func(channelName string) bool
+
+// Member is a connection bound to a channel with presence. It is the body of JoinOpcode and LeaveOpcode messages,
+// and a PresenceResponseOpcode message has a list of them.
+type Member struct {
+	ID       string `json:"id"`       // ID is the ID the server assigned to the connection.
+	Identity string `json:"identity"` // Identity is who the connection belongs to, from ConnectionAuth (or the ID if there is none).
+}
+
+// memberOf returns the Member the connection shows up as.
+func memberOf(conn Connection) Member {
+	return Member{ID: conn.ID(), Identity: identityOf(conn)}
+}
+
+// presenceEvent builds a JoinOpcode or LeaveOpcode message for the member.
+func presenceEvent(opcode uint16, channelName string, member Member) *Message {
+	b, _ := json.Marshal(member)
+	return &Message{Opcode: opcode, ChannelName: channelName, Uuid: newUUID(), Sender: member.Identity, Body: b}
+}
+
+// hasPresence checks if presence is turned on for the channel.
+func (h *MultiPlexHub) hasPresence(channelName string) bool {
+	return h.presence != nil && h.presence(channelName)
+}
+
+// announcePresence tells the channel and the sisters that a local connection joined or left.
+func (h *MultiPlexHub) announcePresence(shard *hubShard, opcode uint16, channelName string, conn Connection) {
+	if !h.hasPresence(channelName) {
+		return
+	}
+	event := presenceEvent(opcode, channelName, memberOf(conn))
+	h.broadcastPresence(shard, event, conn)
+	h.forwardPresence(event)
+}
+
+// forwardPresence sends an event the hub made to the sisters. It goes in the deduper first,
+// so the hub drops it when a sister sends it back.
+func (h *MultiPlexHub) forwardPresence(event *Message) {
+	if h.sisterManager == nil {
+		return
+	}
+	if h.deduper != nil {
+		h.deduper.Add(event)
+	}
+	h.sisterManager.Write(event)
+}
+
+// broadcastPresence sends the event to the connections bound to the channel, except the one it is about.
+func (h *MultiPlexHub) broadcastPresence(shard *hubShard, event *Message, skip Connection) {
+	ch, ok := shard.channels[event.ChannelName]
+	if !ok {
+		return
+	}
+	pm := NewPreparedMessage(event)
+	for _, conn := range ch.connections {
+		if conn != skip {
+			writePrepared(conn, pm)
+		}
+	}
+}
+
+// sisterPresence keeps track of a member that joined or left a channel on a sister server,
+// then passes the event on to the local connections and the other sisters.
+func (h *MultiPlexHub) sisterPresence(shard *hubShard, data *hubData) {
+	if !data.isSister || !h.hasPresence(data.message.ChannelName) {
+		return
+	}
+	var member Member
+	if err := json.Unmarshal(data.message.Body, &member); err != nil || member.ID == "" {
+		return
+	}
+	if h.registry.get(member.ID) != nil {
+		return // the member is one of our connections, so we already know.
+	}
+	if data.message.Opcode == JoinOpcode {
+		shard.addRemoteMember(data.conn, data.message.ChannelName, member)
+	} else if !shard.removeRemoteMember(data.conn, data.message.ChannelName, member.ID) {
+		return // we never saw it join (or already saw it leave), so there is nothing to tell anyone.
+	}
+	h.broadcastPresence(shard, data.message, nil)
+	if h.sisterManager != nil {
+		h.sisterManager.Write(data.message)
+	}
+}
+
+// dropSisterPresence makes the members that came from a sister leave once the sister disconnects,
+// and tells the other sisters they left.
+func (h *MultiPlexHub) dropSisterPresence(shard *hubShard, sister Connection) {
+	channels, ok := shard.remote[sister]
+	if !ok {
+		return
+	}
+	delete(shard.remote, sister)
+	for channelName, members := range channels {
+		for _, member := range members {
+			event := presenceEvent(LeaveOpcode, channelName, member)
+			h.broadcastPresence(shard, event, nil)
+			h.forwardPresence(event)
+		}
+	}
+}
+
+// presenceQuery answers a PresenceQueryOpcode message with the local and remote members of the channel.
+func (h *MultiPlexHub) presenceQuery(shard *hubShard, data *hubData) {
+	if data.isSister {
+		return
+	}
+	if !h.hasPresence(data.message.ChannelName) {
+		perr := &ProtocolError{Code: ErrCodePresenceDisabled, Reason: "channel doesn't have presence"}
+		data.conn.Write(perr.errorMessage(data.message))
+		return
+	}
+	if h.auther != nil && !h.auther.CanBind(data.conn, data.message) {
+		perr := &ProtocolError{Code: ErrCodeUnauthorized, Reason: "presence query not allowed"}
+		data.conn.Write(perr.errorMessage(data.message))
+		return
+	}
+
+	ch, ok := shard.channels[data.message.ChannelName]
+	if !ok {
+		ch = &channel{policy: h.channelPolicy(data.message.ChannelName)}
+	}
+	if ch.policy.Private && !ch.has(data.conn) {
+		perr := &ProtocolError{Code: ErrCodeUnauthorized, Reason: "only members can query a private channel"}
+		data.conn.Write(perr.errorMessage(data.message))
+		return
+	}
+	members := []Member{}
+	for _, conn := range ch.connections {
+		members = append(members, memberOf(conn))
+	}
+	for _, channels := range shard.remote {
+		for _, member := range channels[data.message.ChannelName] {
+			members = append(members, member)
+		}
+	}
+	b, _ := json.Marshal(members)
+	data.conn.Write(&Message{Opcode: PresenceResponseOpcode, ChannelName: data.message.ChannelName, Uuid: data.message.Uuid, Body: b})
+}
+
+// addRemoteMember records a member that joined the channel on the sister's side.
+func (s *hubShard) addRemoteMember(sister Connection, channelName string, member Member) {
+	channels, ok := s.remote[sister]
+	if !ok {
+		channels = make(map[string]map[string]Member)
+		s.remote[sister] = channels
+	}
+	members, ok := channels[channelName]
+	if !ok {
+		members = make(map[string]Member)
+		channels[channelName] = members
+	}
+	members[member.ID] = member
+}
+
+// removeRemoteMember forgets a member that left the channel on the sister's side. It returns false if it wasn't there.
+func (s *hubShard) removeRemoteMember(sister Connection, channelName, id string) bool {
+	members, ok := s.remote[sister][channelName]
+	if !ok {
+		return false
+	}
+	if _, ok := members[id]; !ok {
+		return false
+	}
+	delete(members, id)
+	if len(members) == 0 {
+		delete(s.remote[sister], channelName)
+		if len(s.remote[sister]) == 0 {
+			delete(s.remote, sister)
+		}
+	}
+	return true
+}
@@ -0,0 +1,296 @@
+package conductor
+
+import (
+	"math"
+
+	"github.com/gorilla/websocket"
+	"google.golang.org/protobuf/encoding/protowire"
+)
+
+// field numbers from message.proto.
+const (
+	protoFlags       = 1
+	protoOpcode      = 2
+	protoUuid        = 3
+	protoChannelName = 4
+	protoBody        = 5
+	protoExtensions  = 6
+	protoHeaders     = 7
+	protoSender      = 8
+	protoSequence    = 9
+	protoTimestamp   = 10
+
+	protoExtensionType  = 1
+	protoExtensionValue = 2
+
+	protoMapKey   = 1
+	protoMapValue = 2
+)
+
+// ProtobufCodec sends each message as the protobuf Message described in message.proto.
+// Clients can generate their own bindings from that schema with their usual protobuf toolchain.
+type ProtobufCodec struct {
+}
+
+// Name returns the subprotocol of protobuf frames.
+func (c *ProtobufCodec) Name() string {
+	return "conductor.protobuf"
+}
+
+// FrameType sends binary frames.
+func (c *ProtobufCodec) FrameType() int {
+	return websocket.BinaryMessage
+}
+
+// Marshal encodes the message as protobuf. Zero values are skipped, just like proto3 does.
+func (c *ProtobufCodec) Marshal(message *Message) ([]byte, error) {
+	return c.AppendMarshal(nil, message)
+}
+
+// AppendMarshal appends the protobuf encoding of the message to b.
+func (c *ProtobufCodec) AppendMarshal(b []byte, message *Message) ([]byte, error) {
+	if message.Flags != 0 {
+		b = protowire.AppendTag(b, protoFlags, protowire.VarintType)
+		b = protowire.AppendVarint(b, uint64(message.Flags))
+	}
+	if message.Opcode != 0 {
+		b = protowire.AppendTag(b, protoOpcode, protowire.VarintType)
+		b = protowire.AppendVarint(b, uint64(message.Opcode))
+	}
+	if message.Uuid != "" {
+		b = protowire.AppendTag(b, protoUuid, protowire.BytesType)
+		b = protowire.AppendString(b, message.Uuid)
+	}
+	if message.ChannelName != "" {
+		b = protowire.AppendTag(b, protoChannelName, protowire.BytesType)
+		b = protowire.AppendString(b, message.ChannelName)
+	}
+	if len(message.Body) > 0 {
+		b = protowire.AppendTag(b, protoBody, protowire.BytesType)
+		b = protowire.AppendBytes(b, message.Body)
+	}
+	for _, ext := range message.Extensions {
+		if fieldExtension(ext.Type) {
+			return b, ErrFieldExtension
+		}
+		var size int
+		if ext.Type != 0 {
+			size += protowire.SizeTag(protoExtensionType) + protowire.SizeVarint(uint64(ext.Type))
+		}
+		if len(ext.Value) > 0 {
+			size += protowire.SizeTag(protoExtensionValue) + protowire.SizeBytes(len(ext.Value))
+		}
+		b = protowire.AppendTag(b, protoExtensions, protowire.BytesType)
+		b = protowire.AppendVarint(b, uint64(size))
+		if ext.Type != 0 {
+			b = protowire.AppendTag(b, protoExtensionType, protowire.VarintType)
+			b = protowire.AppendVarint(b, uint64(ext.Type))
+		}
+		if len(ext.Value) > 0 {
+			b = protowire.AppendTag(b, protoExtensionValue, protowire.BytesType)
+			b = protowire.AppendBytes(b, ext.Value)
+		}
+	}
+	if message.Sender != "" {
+		b = protowire.AppendTag(b, protoSender, protowire.BytesType)
+		b = protowire.AppendString(b, message.Sender)
+	}
+	if message.Sequence != 0 {
+		b = protowire.AppendTag(b, protoSequence, protowire.VarintType)
+		b = protowire.AppendVarint(b, message.Sequence)
+	}
+	if message.Timestamp != 0 {
+		b = protowire.AppendTag(b, protoTimestamp, protowire.VarintType)
+		b = protowire.AppendVarint(b, uint64(message.Timestamp))
+	}
+	for k, v := range message.Headers {
+		size := protowire.SizeTag(protoMapKey) + protowire.SizeBytes(len(k)) +
+			protowire.SizeTag(protoMapValue) + protowire.SizeBytes(len(v))
+		b = protowire.AppendTag(b, protoHeaders, protowire.BytesType)
+		b = protowire.AppendVarint(b, uint64(size))
+		b = protowire.AppendTag(b, protoMapKey, protowire.BytesType)
+		b = protowire.AppendString(b, k)
+		b = protowire.AppendTag(b, protoMapValue, protowire.BytesType)
+		b = protowire.AppendString(b, v)
+	}
+	return b, nil
+}
+
+// Unmarshal decodes a protobuf message. Unknown fields are skipped.
+func (c *ProtobufCodec) Unmarshal(b []byte) (*Message, error) {
+	var m Message
+	for len(b) > 0 {
+		num, typ, n := protowire.ConsumeTag(b)
+		if n < 0 {
+			return nil, protowire.ParseError(n)
+		}
+		b = b[n:]
+		switch {
+		case num == protoFlags && typ == protowire.VarintType:
+			v, n := protowire.ConsumeVarint(b)
+			if n < 0 {
+				return nil, protowire.ParseError(n)
+			}
+			if v > math.MaxUint16 {
+				return nil, &DecodeError{Field: "flags", Err: ErrTooLarge}
+			}
+			m.Flags = uint16(v)
+			b = b[n:]
+		case num == protoOpcode && typ == protowire.VarintType:
+			v, n := protowire.ConsumeVarint(b)
+			if n < 0 {
+				return nil, protowire.ParseError(n)
+			}
+			if v > math.MaxUint16 {
+				return nil, &DecodeError{Field: "opcode", Err: ErrTooLarge}
+			}
+			m.Opcode = uint16(v)
+			b = b[n:]
+		case num == protoUuid && typ == protowire.BytesType:
+			v, n := protowire.ConsumeString(b)
+			if n < 0 {
+				return nil, protowire.ParseError(n)
+			}
+			m.Uuid = v
+			b = b[n:]
+		case num == protoChannelName && typ == protowire.BytesType:
+			v, n := protowire.ConsumeString(b)
+			if n < 0 {
+				return nil, protowire.ParseError(n)
+			}
+			m.ChannelName = v
+			b = b[n:]
+		case num == protoBody && typ == protowire.BytesType:
+			v, n := protowire.ConsumeBytes(b)
+			if n < 0 {
+				return nil, protowire.ParseError(n)
+			}
+			m.Body = append([]byte(nil), v...)
+			b = b[n:]
+		case num == protoExtensions && typ == protowire.BytesType:
+			v, n := protowire.ConsumeBytes(b)
+			if n < 0 {
+				return nil, protowire.ParseError(n)
+			}
+			ext, err := unmarshalProtoExtension(v)
+			if err != nil {
+				return nil, err
+			}
+			m.Extensions = append(m.Extensions, ext)
+			b = b[n:]
+		case num == protoHeaders && typ == protowire.BytesType:
+			v, n := protowire.ConsumeBytes(b)
+			if n < 0 {
+				return nil, protowire.ParseError(n)
+			}
+			k, val, err := unmarshalProtoMapEntry(v)
+			if err != nil {
+				return nil, err
+			}
+			m.SetHeader(k, val)
+			b = b[n:]
+		case num == protoSender && typ == protowire.BytesType:
+			v, n := protowire.ConsumeString(b)
+			if n < 0 {
+				return nil, protowire.ParseError(n)
+			}
+			m.Sender = v
+			b = b[n:]
+		case num == protoSequence && typ == protowire.VarintType:
+			v, n := protowire.ConsumeVarint(b)
+			if n < 0 {
+				return nil, protowire.ParseError(n)
+			}
+			m.Sequence = v
+			b = b[n:]
+		case num == protoTimestamp && typ == protowire.VarintType:
+			v, n := protowire.ConsumeVarint(b)
+			if n < 0 {
+				return nil, protowire.ParseError(n)
+			}
+			m.Timestamp = int64(v)
+			b = b[n:]
+		default:
+			n := protowire.ConsumeFieldValue(num, typ, b)
+			if n < 0 {
+				return nil, protowire.ParseError(n)
+			}
+			b = b[n:]
+		}
+	}
+	return &m, nil
+}
+
+func unmarshalProtoExtension(b []byte) (Extension, error) {
+	var ext Extension
+	for len(b) > 0 {
+		num, typ, n := protowire.ConsumeTag(b)
+		if n < 0 {
+			return ext, protowire.ParseError(n)
+		}
+		b = b[n:]
+		switch {
+		case num == protoExtensionType && typ == protowire.VarintType:
+			v, n := protowire.ConsumeVarint(b)
+			if n < 0 {
+				return ext, protowire.ParseError(n)
+			}
+			if v > math.MaxUint16 {
+				return ext, &DecodeError{Field: "extension type", Err: ErrTooLarge}
+			}
+			ext.Type = uint16(v)
+			b = b[n:]
+		case num == protoExtensionValue && typ == protowire.BytesType:
+			v, n := protowire.ConsumeBytes(b)
+			if n < 0 {
+				return ext, protowire.ParseError(n)
+			}
+			ext.Value = append([]byte(nil), v...)
+			b = b[n:]
+		default:
+			n := protowire.ConsumeFieldValue(num, typ, b)
+			if n < 0 {
+				return ext, protowire.ParseError(n)
+			}
+			b = b[n:]
+		}
+	}
+	if fieldExtension(ext.Type) {
+		return ext, &DecodeError{Field: "extension type", Err: ErrFieldExtension}
+	}
+	return ext, nil
+}
+
+func unmarshalProtoMapEntry(b []byte) (string, string, error) {
+	var key, value string
+	for len(b) > 0 {
+		num, typ, n := protowire.ConsumeTag(b)
+		if n < 0 {
+			return "", "", protowire.ParseError(n)
+		}
+		b = b[n:]
+		switch {
+		case num == protoMapKey && typ == protowire.BytesType:
+			v, n := protowire.ConsumeString(b)
+			if n < 0 {
+				return "", "", protowire.ParseError(n)
+			}
+			key = v
+			b = b[n:]
+		case num == protoMapValue && typ == protowire.BytesType:
+			v, n := protowire.ConsumeString(b)
+			if n < 0 {
+				return "", "", protowire.ParseError(n)
+			}
+			value = v
+			b = b[n:]
+		default:
+			n := protowire.ConsumeFieldValue(num, typ, b)
+			if n < 0 {
+				return "", "", protowire.ParseError(n)
+			}
+			b = b[n:]
+		}
+	}
+	return key, value, nil
+}
@@ -0,0 +1,53 @@
+package conductor
+
+import (
+	"errors"
+	"math"
+	"testing"
+
+	"google.golang.org/protobuf/encoding/protowire"
+)
+
+// TestProtobufVarintRange checks varints too big for the uint16 fields they go in are refused instead of truncated.
+func TestProtobufVarintRange(t *testing.T) {
+	extension := func(extType uint64) []byte {
+		ext := protowire.AppendTag(nil, protoExtensionType, protowire.VarintType)
+		return protowire.AppendVarint(ext, extType)
+	}
+	tests := []struct {
+		field string
+		num   protowire.Number
+		value []byte
+	}{
+		{field: "flags", num: protoFlags},
+		{field: "opcode", num: protoOpcode},
+		{field: "extension type", num: protoExtensions, value: extension(math.MaxUint16 + 1)},
+	}
+	for _, tt := range tests {
+		var b []byte
+		if tt.value == nil {
+			b = protowire.AppendTag(nil, tt.num, protowire.VarintType)
+			b = protowire.AppendVarint(b, math.MaxUint16+1)
+		} else {
+			b = protowire.AppendTag(nil, tt.num, protowire.BytesType)
+			b = protowire.AppendBytes(b, tt.value)
+		}
+		var de *DecodeError
+		if _, err := (&ProtobufCodec{}).Unmarshal(b); !errors.Is(err, ErrTooLarge) || !errors.As(err, &de) || de.Field != tt.field {
+			t.Fatalf("%s: %v", tt.field, err)
+		}
+	}
+
+	m := &Message{Flags: math.MaxUint16, Opcode: math.MaxUint16, Uuid: "u", Extensions: []Extension{{Type: math.MaxUint16, Value: []byte("x")}}}
+	b, err := (&ProtobufCodec{}).Marshal(m)
+	if err != nil {
+		t.Fatal(err)
+	}
+	got, err := (&ProtobufCodec{}).Unmarshal(b)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got.Flags != m.Flags || got.Opcode != m.Opcode || got.Extensions[0].Type != math.MaxUint16 {
+		t.Fatalf("decoded %+v", got)
+	}
+}
@@ -0,0 +1,127 @@
+package conductor
+
+import (
+	"errors"
+	"sync"
+	"sync/atomic"
+)
+
+// OverflowPolicy decides what a connection does when its outbound queue is full.
+type OverflowPolicy int
+
+const (
+	DropOldest             OverflowPolicy = iota // DropOldest throws away the oldest queued message to make room for the new one.
+	DropNewest                                   // DropNewest throws away the new message.
+	DisconnectSlowConsumer                       // DisconnectSlowConsumer disconnects the connection, since it can't keep up.
+)
+
+const (
+	// how many messages can wait to be written to a connection by default.
+	defaultQueueSize = 256
+)
+
+var (
+	// ErrQueueFull is returned by Write when the message was dropped because the outbound queue is full.
+	ErrQueueFull = errors.New("conductor: outbound queue is full")
+
+	// ErrSlowConsumer is returned by Write when the connection was disconnected because its outbound queue is full.
+	ErrSlowConsumer = errors.New("conductor: connection is too slow to keep up")
+
+	// ErrConnectionClosed is returned by Write once the connection is closed.
+	ErrConnectionClosed = errors.New("conductor: connection is closed")
+)
+
+// QueueMonitor is implemented by connections that queue their outbound messages.
+// Use it to keep an eye on clients that are falling behind.
+type QueueMonitor interface {
+	QueueDepth() int      // QueueDepth is how many messages are waiting to be written.
+	QueueCapacity() int   // QueueCapacity is how many messages can wait before the OverflowPolicy kicks in.
+	QueueDropped() uint64 // QueueDropped is how many messages the DropOldest or DropNewest policy has thrown away.
+}
+
+// outbound is a message waiting in a queue. Prepared messages are written as is, so they are only encoded once.
+type outbound struct {
+	message  *Message
+	prepared *PreparedMessage
+}
+
+// outboundQueue is a bounded queue of messages waiting for a connection's writer goroutine.
+// Writers never block on it, the OverflowPolicy decides what happens when it's full.
+type outboundQueue struct {
+	mu       sync.Mutex
+	messages chan outbound
+	policy   OverflowPolicy
+
+	// how many messages the policy threw away.
+	dropped uint64
+
+	// closed once the queue stops taking messages. reason says why.
+	done      chan struct{}
+	closeOnce sync.Once
+	reason    error
+}
+
+func newOutboundQueue(size int, policy OverflowPolicy) *outboundQueue {
+	if size <= 0 {
+		size = defaultQueueSize
+	}
+	return &outboundQueue{messages: make(chan outbound, size), policy: policy, done: make(chan struct{})}
+}
+
+// push adds the message to the queue, applying the policy if the queue is full.
+func (q *outboundQueue) push(out outbound) error {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	select {
+	case <-q.done:
+		return ErrConnectionClosed
+	default:
+	}
+	select {
+	case q.messages <- out:
+		return nil
+	default:
+	}
+	switch q.policy {
+	case DropNewest:
+		atomic.AddUint64(&q.dropped, 1)
+		return ErrQueueFull
+	case DropOldest:
+		// every pusher holds the lock and the writer only takes messages out, so there is room after this.
+		select {
+		case <-q.messages:
+			atomic.AddUint64(&q.dropped, 1)
+		default:
+		}
+		q.messages <- out
+		return nil
+	default:
+		q.close(ErrSlowConsumer)
+		return ErrSlowConsumer
+	}
+}
+
+// close stops the queue from taking messages. The first reason given sticks.
+func (q *outboundQueue) close(reason error) {
+	q.closeOnce.Do(func() {
+		q.reason = reason
+		close(q.done)
+	})
+}
+
+// closeReason returns why the queue was closed. Only call this once done is closed.
+func (q *outboundQueue) closeReason() error {
+	return q.reason
+}
+
+func (q *outboundQueue) depth() int {
+	return len(q.messages)
+}
+
+func (q *outboundQueue) capacity() int {
+	return cap(q.messages)
+}
+
+func (q *outboundQueue) droppedCount() uint64 {
+	return atomic.LoadUint64(&q.dropped)
+}
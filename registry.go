@@ -0,0 +1,102 @@
+package conductor
+
+import (
+	"errors"
+	"sync"
+)
+
+// ErrUnknownConnection is returned when no connection has the ID provided.
+var ErrUnknownConnection = errors.New("conductor: no connection with that ID")
+
+// registry indexes the hub's client connections by ID and by the values they have stored under the index keys
+// (like IdentityKey), so server code and direct messages can find them without scanning every channel.
+// Only string values are indexed.
+// A connection is indexed by the values it has when it is registered, which is right after ConnToRequest.
+type registry struct {
+	mu      sync.RWMutex
+	keys    []string
+	entries map[string]registryEntry
+	byKey   map[string]map[string][]Connection // by key, then value.
+}
+
+// registryEntry is a registered connection and the values it was indexed by, in the same order as the keys.
+type registryEntry struct {
+	conn   Connection
+	values []string
+}
+
+func newRegistry(keys ...string) *registry {
+	r := &registry{entries: make(map[string]registryEntry), byKey: make(map[string]map[string][]Connection)}
+	r.index(keys...)
+	return r
+}
+
+// index adds keys to index connections by. Only connections registered after this are indexed by them.
+func (r *registry) index(keys ...string) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	for _, key := range keys {
+		if _, ok := r.byKey[key]; !ok {
+			r.keys = append(r.keys, key)
+			r.byKey[key] = make(map[string][]Connection)
+		}
+	}
+}
+
+// add registers the connection.
+func (r *registry) add(conn Connection) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	entry := registryEntry{conn: conn, values: make([]string, len(r.keys))}
+	for i, key := range r.keys {
+		value := GetString(conn, key)
+		entry.values[i] = value
+		if value != "" {
+			r.byKey[key][value] = append(r.byKey[key][value], conn)
+		}
+	}
+	r.entries[conn.ID()] = entry
+}
+
+// remove unregisters the connection.
+func (r *registry) remove(conn Connection) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	entry, ok := r.entries[conn.ID()]
+	if !ok {
+		return
+	}
+	delete(r.entries, conn.ID())
+	for i, value := range entry.values {
+		if value == "" {
+			continue
+		}
+		byValue := r.byKey[r.keys[i]]
+		conns := byValue[value]
+		for j, c := range conns {
+			if c == conn {
+				conns = append(conns[:j:j], conns[j+1:]...)
+				break
+			}
+		}
+		if len(conns) == 0 {
+			delete(byValue, value)
+		} else {
+			byValue[value] = conns
+		}
+	}
+}
+
+// get returns the connection with the ID, or nil if there is none.
+func (r *registry) get(id string) Connection {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	return r.entries[id].conn
+}
+
+// getBy returns the connections with the value stored under the key. The key has to be one of the index keys.
+func (r *registry) getBy(key, value string) []Connection {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	return append([]Connection(nil), r.byKey[key][value]...)
+}
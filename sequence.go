@@ -0,0 +1,59 @@
+package conductor
+
+import "container/list"
+
+const (
+	// how many channels without state each shard remembers the last sequence of.
+	retiredSequencesSize = 1024
+)
+
+// retiredSequences remembers the last sequence of channels the shard has no state for, like channels everybody
+// unbound from or that only pattern subscriptions match, so their sequence goes on where it left off.
+// It only holds so many channels. The ones used least recently are forgotten first and start over at one.
+type retiredSequences struct {
+	limit    int
+	order    *list.List // of *retiredSequence, the most recently used at the back.
+	channels map[string]*list.Element
+}
+
+type retiredSequence struct {
+	channelName string
+	sequence    uint64
+}
+
+func newRetiredSequences(limit int) *retiredSequences {
+	return &retiredSequences{limit: limit, order: list.New(), channels: make(map[string]*list.Element)}
+}
+
+// take returns the last sequence of the channel and forgets it, since the channel has state again.
+func (r *retiredSequences) take(channelName string) uint64 {
+	e, ok := r.channels[channelName]
+	if !ok {
+		return 0
+	}
+	r.order.Remove(e)
+	delete(r.channels, channelName)
+	return e.Value.(*retiredSequence).sequence
+}
+
+// put remembers the last sequence of the channel, forgetting the least recently used channel if there are too many.
+func (r *retiredSequences) put(channelName string, sequence uint64) {
+	if e, ok := r.channels[channelName]; ok {
+		e.Value.(*retiredSequence).sequence = sequence
+		r.order.MoveToBack(e)
+		return
+	}
+	r.channels[channelName] = r.order.PushBack(&retiredSequence{channelName: channelName, sequence: sequence})
+	if r.order.Len() > r.limit {
+		oldest := r.order.Front()
+		r.order.Remove(oldest)
+		delete(r.channels, oldest.Value.(*retiredSequence).channelName)
+	}
+}
+
+// next returns the sequence number for a new write to the channel.
+func (r *retiredSequences) next(channelName string) uint64 {
+	sequence := r.take(channelName) + 1
+	r.put(channelName, sequence)
+	return sequence
+}
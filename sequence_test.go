@@ -0,0 +1,77 @@
+package conductor
+
+import (
+	"context"
+	"fmt"
+	"testing"
+)
+
+func TestRetiredSequences(t *testing.T) {
+	r := newRetiredSequences(2)
+	r.put("a", 5)
+	r.put("b", 7)
+	if got := r.next("a"); got != 6 {
+		t.Fatalf("a went on at %d", got)
+	}
+	r.put("c", 1) // b is the least recently used now.
+	if got := r.take("b"); got != 0 {
+		t.Fatalf("b wasn't forgotten: %d", got)
+	}
+	if got := r.take("a"); got != 6 {
+		t.Fatalf("a is %d", got)
+	}
+	if got := r.take("a"); got != 0 {
+		t.Fatalf("a wasn't taken: %d", got)
+	}
+	if r.order.Len() != 1 || len(r.channels) != 1 {
+		t.Fatalf("holding %d and %d", r.order.Len(), len(r.channels))
+	}
+}
+
+// TestSequenceOutlivesChannel checks a channel's sequence goes on when it only has pattern subscribers
+// and after everybody unbinds from it.
+func TestSequenceOutlivesChannel(t *testing.T) {
+	h := NewMultiPlexHub(nil, nil, nil, nil, nil)
+	go h.RunLoop()
+	defer h.Shutdown(context.Background())
+	a, b := NewMemoryConnection(h), NewMemoryConnection(h)
+	b.Send(&Message{Opcode: BindOpcode, ChannelName: "s.*"})
+	h.Sync()
+	a.Send(&Message{Opcode: WriteOpcode, ChannelName: "s.x"})
+	a.Send(&Message{Opcode: WriteOpcode, ChannelName: "s.x"})
+	b.Send(&Message{Opcode: BindOpcode, ChannelName: "s.x"})
+	a.Send(&Message{Opcode: WriteOpcode, ChannelName: "s.x"})
+	b.Send(&Message{Opcode: UnbindOpcode, ChannelName: "s.x"})
+	a.Send(&Message{Opcode: WriteOpcode, ChannelName: "s.x"})
+	h.Sync()
+	want := uint64(1)
+	for _, m := range b.Messages() {
+		if m.Opcode != WriteOpcode {
+			continue
+		}
+		if m.Sequence != want {
+			t.Fatalf("write %d has sequence %d", want, m.Sequence)
+		}
+		want++
+	}
+	if want != 5 {
+		t.Fatalf("got %d writes", want-1)
+	}
+}
+
+// TestSequenceNotKeptWithoutSubscribers checks writes nobody is subscribed to don't leave sequences behind.
+func TestSequenceNotKeptWithoutSubscribers(t *testing.T) {
+	h := NewMultiPlexHub(nil, nil, nil, nil, nil)
+	go h.RunLoop()
+	defer h.Shutdown(context.Background())
+	a := NewMemoryConnection(h)
+	for i := 0; i < 100; i++ {
+		a.Send(&Message{Opcode: WriteOpcode, ChannelName: fmt.Sprintf("nobody.%d", i)})
+	}
+	h.Sync()
+	for i, shard := range h.shards {
+		if len(shard.channels) != 0 || shard.retired.order.Len() != 0 {
+			t.Fatalf("shard %d holds %d channels and %d sequences", i, len(shard.channels), shard.retired.order.Len())
+		}
+	}
+}
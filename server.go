@@ -1,8 +1,15 @@
 package conductor
 
 import (
+	"bufio"
+	"context"
+	"crypto/tls"
 	"fmt"
+	"net"
 	"net/http"
+	"strings"
+	"sync"
+	"time"
 
 	"github.com/gorilla/websocket"
 )
@@ -11,6 +18,7 @@ import (
 type ServerClient interface {
 	Start(useHTTPServer bool) error
 	AddSister(sister SisterClient) error
+	Shutdown(ctx context.Context) error
 }
 
 // Server is the implementation of ServerClient.
@@ -19,7 +27,20 @@ type Server struct {
 	CertName string
 	KeyName  string
 	Router   http.Handler
-	h        Hub
+
+	// Options are the limits and timeouts of the connections. Change them before Start.
+	Options ServerOptions
+
+	h Hub
+
+	// guards the fields below, which Shutdown uses to stop the server.
+	mu           sync.Mutex
+	httpServer   *http.Server
+	listeners    map[net.Listener]struct{}
+	sessions     map[string]*httpconnection
+	conns        map[Connection]struct{}
+	handlers     sync.WaitGroup
+	shuttingDown bool
 }
 
 // New takes in everything need to setup a Server and have all the interfaces implemented.
@@ -30,29 +51,131 @@ type Server struct {
 // serverHandler is the ServerHubHandler interface to use for one to one operations.
 // sisterManager is the SisterManager interface to use for handling federation.
 func New(port int, deduper DeDuplication, auther ConnectionAuth, storer Storage, serverHandler ServerHubHandler, sisterManager SisterManager) *Server {
-	return &Server{Port: port,
-		h: newMultiPlexHub(deduper, auther, storer, serverHandler, sisterManager)}
+	return &Server{Port: port, Options: DefaultServerOptions(),
+		h: NewMultiPlexHub(deduper, auther, storer, serverHandler, sisterManager)}
 }
 
 //Start starts the websocket server to allow connections.
 //useHTTPServer is if conductor should start an HTTP server or not.
 //Set this to no if you are going to install the WebsocketHandler into your own HTTP system.
+//Once Shutdown is called, Start returns nil.
 func (s *Server) Start(useHTTPServer bool) error {
 	go s.h.RunLoop()
 	if useHTTPServer {
 		http.HandleFunc("/", s.WebsocketHandler)
+		httpServer := &http.Server{Addr: fmt.Sprintf(":%d", s.Port), Handler: s.Router}
+		s.mu.Lock()
+		s.httpServer = httpServer
+		s.mu.Unlock()
+
+		var err error
 		// need a better TLS listener. This is really basic.
 		if s.CertName != "" && s.KeyName != "" {
-			return http.ListenAndServeTLS(fmt.Sprintf(":%d", s.Port), s.CertName, s.KeyName, s.Router)
+			err = httpServer.ListenAndServeTLS(s.CertName, s.KeyName)
+		} else {
+			err = httpServer.ListenAndServe()
+		}
+		if err == http.ErrServerClosed {
+			return nil
 		}
-		return http.ListenAndServe(fmt.Sprintf(":%d", s.Port), s.Router)
+		return err
 	}
 	return nil
 }
 
+//ListenTCP listens for raw TCP connections on the address, for backend services and sisters that don't need
+//websockets. With a TLS config the connections use TLS. See ServeTCP.
+func (s *Server) ListenTCP(addr string, config *tls.Config) error {
+	l, err := net.Listen("tcp", addr)
+	if err != nil {
+		return err
+	}
+	if config != nil {
+		l = tls.NewListener(l, config)
+	}
+	return s.ServeTCP(l)
+}
+
+//ServeTCP accepts raw TCP connections on the listener and hands them to the same hub as the websockets.
+//Clients and sisters connect to it with a tcp:// or tls:// URL. The handshake is an HTTP request,
+//so ConnectionAuth works the same as it does for websockets.
+//Start has to be called first, since it starts the hub. Once Shutdown is called, ServeTCP returns nil.
+func (s *Server) ServeTCP(l net.Listener) error {
+	s.mu.Lock()
+	if s.shuttingDown {
+		s.mu.Unlock()
+		l.Close()
+		return nil
+	}
+	if s.listeners == nil {
+		s.listeners = make(map[net.Listener]struct{})
+	}
+	s.listeners[l] = struct{}{}
+	s.mu.Unlock()
+	defer func() {
+		s.mu.Lock()
+		delete(s.listeners, l)
+		s.mu.Unlock()
+	}()
+
+	for {
+		conn, err := l.Accept()
+		if err != nil {
+			s.mu.Lock()
+			shuttingDown := s.shuttingDown
+			s.mu.Unlock()
+			if shuttingDown {
+				return nil
+			}
+			return err
+		}
+		go s.tcpHandler(conn)
+	}
+}
+
+//Shutdown gracefully stops the server. New upgrades get a 503, and every connection gets a going away close frame
+//once its queued messages are written (raw TCP connections are just closed after that). When the connections are gone the hub is shut down,
+//which disconnects the sisters, stops the background goroutines and flushes the storage.
+//If ctx is done first, Shutdown returns the context's error.
+func (s *Server) Shutdown(ctx context.Context) error {
+	s.mu.Lock()
+	s.shuttingDown = true
+	httpServer := s.httpServer
+	for l := range s.listeners {
+		l.Close()
+	}
+	conns := make([]Connection, 0, len(s.conns))
+	for conn := range s.conns {
+		conns = append(conns, conn)
+	}
+	s.mu.Unlock()
+
+	// the connections go away first, since the HTTP server waits for fallback streams to end.
+	for _, conn := range conns {
+		goAwayOrDisconnect(conn)
+	}
+	if httpServer != nil {
+		if err := httpServer.Shutdown(ctx); err != nil {
+			return err
+		}
+	}
+	if err := waitContext(ctx, &s.handlers); err != nil {
+		return err
+	}
+	return s.h.Shutdown(ctx)
+}
+
+// connectionOptions returns the Options, with the defaults filled in.
+func (s *Server) connectionOptions() ServerOptions {
+	return s.Options.withDefaults()
+}
+
 //AddSister adds a sister server to use for federation.
 // It sends and receives messages to the other server.
 func (s *Server) AddSister(sister SisterClient) error {
+	if o, ok := sister.(OptionsUser); ok {
+		o.UseOptions(s.connectionOptions())
+	}
 	if err := sister.Connect(s.h); err != nil {
 		return err
 	}
@@ -61,20 +184,110 @@ func (s *Server) AddSister(sister SisterClient) error {
 	return nil
 }
 
+//SetValidator replaces the validator messages from clients go through before the hub processes them.
+//The default is a StandardValidator. Set it to nil to turn validation off. Call this before Start.
+func (s *Server) SetValidator(validator MessageValidator) {
+	s.h.SetValidator(validator)
+}
+
+//SetChannelObserver sets the observer notified when channels are created, gain or lose a subscriber,
+//become empty or are destroyed. Call this before Start.
+func (s *Server) SetChannelObserver(observer ChannelObserver) {
+	s.h.SetChannelObserver(observer)
+}
+
+//SetPresence turns presence on for the channels the filter returns true for.
+//Those channels broadcast join and leave events and answer presence queries. Call this before Start.
+func (s *Server) SetPresence(filter PresenceFilter) {
+	s.h.SetPresence(filter)
+}
+
+//SetChannelPolicies sets the provider consulted when a channel is created, to decide its subscriber limit,
+//whether writes are echoed and persisted, and whether it is private. See PatternPolicyProvider. Call this before Start.
+func (s *Server) SetChannelPolicies(provider ChannelPolicyProvider) {
+	s.h.SetChannelPolicies(provider)
+}
+
+//Use adds middleware to the messages coming into the hub, like filters, enrichment or metrics.
+//Middleware added first sees messages first. Call this before Start.
+func (s *Server) Use(middleware ...Middleware) {
+	s.h.Use(middleware...)
+}
+
+//IndexKeys makes the connection registry index clients by the values they Store under these keys,
+//so LookupBy can find them (like by an account ID set in ConnToRequest). IdentityKey is always indexed.
+//Call this before Start.
+func (s *Server) IndexKeys(keys ...string) {
+	s.h.IndexKeys(keys...)
+}
+
+//Lookup returns the client with the connection ID, or nil if it isn't connected.
+func (s *Server) Lookup(id string) Connection {
+	return s.h.Lookup(id)
+}
+
+//LookupBy returns the clients with the value stored under the key, which has to be IdentityKey or one of the IndexKeys.
+func (s *Server) LookupBy(key, value string) []Connection {
+	return s.h.LookupBy(key, value)
+}
+
+//SendTo writes the message to the client with the connection ID.
+//It returns ErrUnknownConnection if the client isn't connected.
+func (s *Server) SendTo(id string, message *Message) error {
+	conn := s.h.Lookup(id)
+	if conn == nil {
+		return ErrUnknownConnection
+	}
+	return conn.Write(message)
+}
+
+//SendToUser writes the message to every client of the identity (like every device a user has open).
+//It returns how many clients it was written to.
+func (s *Server) SendToUser(identity string, message *Message) int {
+	sent := 0
+	for _, conn := range s.h.LookupBy(IdentityKey, identity) {
+		if conn.Write(message) == nil {
+			sent++
+		}
+	}
+	return sent
+}
+
+//DisconnectUser disconnects every client of the identity. It returns how many clients were disconnected.
+func (s *Server) DisconnectUser(identity string) int {
+	conns := s.h.LookupBy(IdentityKey, identity)
+	for _, conn := range conns {
+		conn.Disconnect()
+	}
+	return len(conns)
+}
+
 //WebsocketHandler is the handler of the HTTP HandleFunc. This way you can install conductor into your current HTTP stack.
+//Requests that aren't websocket upgrades go to the FallbackHandler.
 func (s *Server) WebsocketHandler(w http.ResponseWriter, r *http.Request) {
+	if !websocket.IsWebSocketUpgrade(r) {
+		s.FallbackHandler(w, r)
+		return
+	}
 	if r.Method != "GET" {
 		http.Error(w, "Method not allowed", 405)
 		return
 	}
+	if !s.startHandler() {
+		http.Error(w, "Server is shutting down", 503)
+		return
+	}
+	defer s.handlers.Done()
+
 	if s.h.Auth() != nil && !s.h.Auth().IsValid(r) {
 		http.Error(w, "Not authorized", 401)
 		return
 	}
 
 	upgrader := websocket.Upgrader{
-		ReadBufferSize:  1024,
-		WriteBufferSize: 1024,
+		ReadBufferSize:  s.connectionOptions().ReadBufferSize,
+		WriteBufferSize: s.connectionOptions().WriteBufferSize,
+		Subprotocols:    codecNames(),
 		CheckOrigin:     func(r *http.Request) bool { return true },
 	}
 	ws, err := upgrader.Upgrade(w, r, nil)
@@ -83,15 +296,105 @@ func (s *Server) WebsocketHandler(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 	isSister := s.h.Auth().IsSister(r)
-	c := newWSConnection(ws, s.h, isSister)
+	s.serve(r, newWSConnection(ws, s.h, isSister, s.connectionOptions()), isSister)
+}
+
+// tcpHandler does the handshake of a raw TCP connection and then serves it like a websocket.
+// Requests that don't ask to upgrade to tcpProtocol (like a plain HTTP request sent to the port by mistake) get a 400.
+func (s *Server) tcpHandler(conn net.Conn) {
+	options := s.connectionOptions()
+	conn.SetReadDeadline(time.Now().Add(handshakeTimeout))
+	limited := &handshakeReader{r: conn, remaining: maxHandshakeSize}
+	reader := bufio.NewReaderSize(limited, options.ReadBufferSize)
+	r, err := http.ReadRequest(reader)
+	if err != nil {
+		conn.Close()
+		return
+	}
+	r.RemoteAddr = conn.RemoteAddr().String()
+	if tlsConn, ok := conn.(*tls.Conn); ok {
+		state := tlsConn.ConnectionState()
+		r.TLS = &state
+	}
+	if !strings.EqualFold(r.Header.Get("Upgrade"), tcpProtocol) {
+		writeHandshakeResponse(conn, http.StatusBadRequest, nil)
+		conn.Close()
+		return
+	}
+
+	if !s.startHandler() {
+		writeHandshakeResponse(conn, http.StatusServiceUnavailable, nil)
+		conn.Close()
+		return
+	}
+	defer s.handlers.Done()
+
+	if s.h.Auth() != nil && !s.h.Auth().IsValid(r) {
+		writeHandshakeResponse(conn, http.StatusUnauthorized, nil)
+		conn.Close()
+		return
+	}
+	codec := pickCodec(r.Header[tcpCodecHeader])
+	if err := writeHandshakeResponse(conn, http.StatusSwitchingProtocols, codec); err != nil {
+		conn.Close()
+		return
+	}
+	conn.SetDeadline(time.Time{})
+	limited.lift()
+
+	isSister := s.h.Auth() != nil && s.h.Auth().IsSister(r)
+	s.serve(r, newTCPConnection(conn, reader, s.h, isSister, options, codec), isSister)
+}
+
+// startHandler counts a connection being set up, so Shutdown waits for it.
+// It returns false when the server is shutting down, and the connection should be turned away.
+func (s *Server) startHandler() bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.shuttingDown {
+		return false
+	}
+	s.handlers.Add(1)
+	return true
+}
+
+// serve hands a connection to the hub and runs its read loop until it disconnects.
+func (s *Server) serve(r *http.Request, c Connection, isSister bool) {
 	if s.h.Auth() != nil {
 		s.h.Auth().ConnToRequest(r, c)
 	}
 	if isSister && s.h.SisterManager() != nil {
 		s.h.SisterManager().SisterConnected(c)
 	}
+	if !isSister {
+		s.h.Connected(c)
+		defer s.h.Disconnected(c)
+	}
+	s.track(c)
+	defer s.untrack(c)
 	c.ReadLoop(s.h)
 	if isSister && s.h.SisterManager() != nil {
 		s.h.SisterManager().SisterDisconnected(c)
 	}
 }
+
+// track keeps hold of the connection, so Shutdown can close it.
+// A connection that shows up while shutting down is closed right away.
+func (s *Server) track(conn Connection) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.shuttingDown {
+		goAwayOrDisconnect(conn)
+		return
+	}
+	if s.conns == nil {
+		s.conns = make(map[Connection]struct{})
+	}
+	s.conns[conn] = struct{}{}
+}
+
+func (s *Server) untrack(conn Connection) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	delete(s.conns, conn)
+}
@@ -0,0 +1,95 @@
+package conductor
+
+import (
+	"hash/fnv"
+)
+
+const (
+	// how many messages can wait for a shard before writers to it block.
+	shardQueueSize = 256
+)
+
+// hubShard owns a slice of the hub's channels.
+// Every message for a channel is processed by the shard that owns it, on that shard's goroutine,
+// so messages on a channel are handled in order while different channels are handled in parallel.
+type hubShard struct {
+	// The state of each channel this shard owns, like the connections bound to it.
+	channels map[string]*channel
+
+	// The sequence number of the last write to channels this shard has no state for.
+	retired *retiredSequences
+
+	// The pattern subscriptions. Every shard has all of them, since a pattern can match channels on any shard.
+	patterns subscriptionTrie
+
+	// The members of this shard's channels that are bound on sister servers, by sister and then channel and member ID.
+	remote map[Connection]map[string]map[string]Member
+
+	// The channel we get messages for this shard on.
+	messages chan *hubData
+}
+
+func newHubShard() *hubShard {
+	return &hubShard{channels: make(map[string]*channel), retired: newRetiredSequences(retiredSequencesSize),
+		remote:   make(map[Connection]map[string]map[string]Member),
+		messages: make(chan *hubData, shardQueueSize)}
+}
+
+// channel returns the state of the channel, creating it if nobody is bound to it yet. created is true if it was.
+func (s *hubShard) channel(channelName string) (ch *channel, created bool) {
+	ch, ok := s.channels[channelName]
+	if !ok {
+		ch = &channel{sequence: s.retired.take(channelName)}
+		s.channels[channelName] = ch
+	}
+	return ch, !ok
+}
+
+// removeConnection unbinds the connection from the channel, if this shard has the channel.
+// The channel is removed once it is empty, so the map only holds channels somebody is bound to.
+// Its sequence is retired, so it goes on where it left off if somebody binds again soon.
+// removed is false if the connection wasn't bound, and destroyed is true if the channel was removed.
+func (s *hubShard) removeConnection(channelName string, c Connection) (removed, destroyed bool) {
+	ch, ok := s.channels[channelName]
+	if !ok || !ch.remove(c) {
+		return false, false
+	}
+	if len(ch.connections) == 0 {
+		delete(s.channels, channelName)
+		if ch.sequence > 0 {
+			s.retired.put(channelName, ch.sequence)
+		}
+		return true, true
+	}
+	return true, false
+}
+
+// subscribers returns the connections bound to the channel directly or through a pattern, each one once.
+// Patterns don't match private channels.
+func (s *hubShard) subscribers(ch *channel, channelName string) []Connection {
+	if s.patterns.empty() || ch.policy.Private {
+		return ch.connections
+	}
+	matched := s.patterns.match(channelName, nil)
+	if len(matched) == 0 {
+		return ch.connections
+	}
+	seen := make(map[Connection]struct{}, len(ch.connections)+len(matched))
+	conns := make([]Connection, 0, len(ch.connections)+len(matched))
+	for _, list := range [][]Connection{ch.connections, matched} {
+		for _, conn := range list {
+			if _, ok := seen[conn]; !ok {
+				seen[conn] = struct{}{}
+				conns = append(conns, conn)
+			}
+		}
+	}
+	return conns
+}
+
+// shardIndex picks the shard that owns the key out of count shards.
+func shardIndex(key string, count int) int {
+	hash := fnv.New32a()
+	hash.Write([]byte(key))
+	return int(hash.Sum32() % uint32(count))
+}
@@ -0,0 +1,52 @@
+package conductor
+
+import (
+	"context"
+	"errors"
+	"sync"
+)
+
+// Stopper is implemented by plugins that run background goroutines (like the StandardDeDuplication ticker)
+// or hold connections (like a SisterClient). The hub calls Stop when it shuts down.
+type Stopper interface {
+	Stop()
+}
+
+// Flusher is implemented by Storage plugins that buffer their writes.
+// The hub calls Flush once every message has been processed on shut down, so nothing is lost.
+type Flusher interface {
+	Flush() error
+}
+
+// goingAway is implemented by connections that can tell their peer the server is shutting down.
+// Their queued messages are written before the close frame.
+type goingAway interface {
+	goAway()
+}
+
+// errGoingAway is the reason a connection's queue is closed when the server shuts down.
+var errGoingAway = errors.New("conductor: server is shutting down")
+
+// goAwayOrDisconnect closes the connection with a going away close frame if it supports one.
+func goAwayOrDisconnect(conn Connection) {
+	if g, ok := conn.(goingAway); ok {
+		g.goAway()
+		return
+	}
+	conn.Disconnect()
+}
+
+// waitContext waits for the WaitGroup, giving up when the context is done.
+func waitContext(ctx context.Context, wg *sync.WaitGroup) error {
+	done := make(chan struct{})
+	go func() {
+		wg.Wait()
+		close(done)
+	}()
+	select {
+	case <-done:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
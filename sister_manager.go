@@ -1,6 +1,9 @@
 package conductor
 
-import "encoding/json"
+import (
+	"encoding/json"
+	"sync"
+)
 
 // SisterManagerClient is the based interface for handling adding sisters.
 type SisterManagerClient interface {
@@ -28,6 +31,7 @@ type SisterManager interface {
 // You also need to consider how many connections from the sisters are open per server.
 // More sisters per server means less available sockets for the clients.
 type SimpleMaxSisterManager struct {
+	mu               sync.RWMutex
 	possibleSisters  []SisterClient // The sisters that you can connect too
 	connectedSisters []SisterClient // The sisters that you are connected too
 }
@@ -60,13 +64,30 @@ func (s *SimpleMaxSisterManager) SisterDisconnected(c Connection) {
 
 // Write forwards this message onto the sisters under its care.
 func (s *SimpleMaxSisterManager) Write(message *Message) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
 	for _, sister := range s.connectedSisters {
 		sister.Write(message)
 	}
 }
 
+// Stop disconnects from the sisters that support it (like SisterServer) and stops forwarding to them.
+func (s *SimpleMaxSisterManager) Stop() {
+	s.mu.Lock()
+	sisters := s.connectedSisters
+	s.connectedSisters = []SisterClient{}
+	s.mu.Unlock()
+	for _, sister := range sisters {
+		if stopper, ok := sister.(Stopper); ok {
+			stopper.Stop()
+		}
+	}
+}
+
 // MetaQueryResponse returns the meta data to use in the response
 func (s *SimpleMaxSisterManager) MetaQueryResponse() []byte {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
 	meta := metaResponse{Count: len(s.connectedSisters)}
 	b, _ := json.Marshal(meta)
 	return b
@@ -81,12 +102,18 @@ func (s *SimpleMaxSisterManager) HandleMetaQueryResponse(b []byte) {
 
 // sendMetaQuery asks the sisters for their meta information.
 func (s *SimpleMaxSisterManager) sendMetaQuery() {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
 	for _, sister := range s.possibleSisters {
 		sister.Write(&Message{Opcode: MetaQueryOpcode, ChannelName: "", Uuid: newUUID()})
 	}
 }
 
-// RegisterSister appends the sister server into this hub for broadcasting
+// RegisterSister appends the sister server into this hub for broadcasting.
+// The server has already connected to the sister by now, so it can start getting messages right away.
 func (s *SimpleMaxSisterManager) addSister(client SisterClient) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
 	s.possibleSisters = append(s.possibleSisters, client)
+	s.connectedSisters = append(s.connectedSisters, client)
 }
@@ -1,6 +1,7 @@
 package conductor
 
 import (
+	"crypto/tls"
 	"net"
 	"net/http"
 	"net/url"
@@ -25,22 +26,36 @@ type SisterClient interface {
 // SisterServer is the standard server that handles interaction between two server and their message hubs.
 // NOTE: I can't stress enough how important a good deduper in the hub is.
 // This is the only way to not get stuck in an infinite messaging loop bouncing between sister to sister.
+// ServerURL can be a websocket URL, or a tcp:// or tls:// URL for a sister listening with ListenTCP.
 type SisterServer struct {
 	ServerURL string
+	TLSConfig *tls.Config // TLSConfig is used for tls:// URLs. nil uses the system roots.
 	headers   map[string]string
+	options   ServerOptions
 	c         Connection
 }
 
+// OptionsUser is implemented by sisters that take the ServerOptions of the server they are added to.
+// Server.AddSister calls UseOptions before Connect.
+type OptionsUser interface {
+	UseOptions(options ServerOptions)
+}
+
 // NewSisterServer creates a new sister server object.
 // serverURL is the other server url to connect with.
 // h is the hub to write to.
 func NewSisterServer(serverURL string, headers map[string]string) *SisterServer {
-	return &SisterServer{ServerURL: serverURL, headers: headers}
+	return &SisterServer{ServerURL: serverURL, headers: headers, options: DefaultServerOptions()}
 }
 
-// Connect creates a WebSocket connection to the other server.
+// UseOptions sets the limits and timeouts of the connection to the other server. Server.AddSister calls this.
+func (s *SisterServer) UseOptions(options ServerOptions) {
+	s.options = options
+}
+
+// Connect creates a WebSocket (or raw TCP) connection to the other server.
 func (s *SisterServer) Connect(h HubConnection) error {
-	c, err := createWS(s.ServerURL, s.headers, h)
+	c, err := createWS(s.ServerURL, s.headers, s.TLSConfig, h, s.options)
 	if err != nil {
 		return err
 	}
@@ -59,14 +74,22 @@ func (s *SisterServer) Write(message *Message) {
 	s.c.Write(message)
 }
 
-func createWS(serverURL string, headers map[string]string, h HubConnection) (Connection, error) {
+// Stop disconnects from the other server, telling it this server is going away.
+func (s *SisterServer) Stop() {
+	if s.c != nil {
+		goAwayOrDisconnect(s.c)
+	}
+}
+
+func createWS(serverURL string, headers map[string]string, config *tls.Config, h HubConnection, options ServerOptions) (Connection, error) {
+	options = options.withDefaults()
 	u, err := url.Parse(serverURL)
 	if err != nil {
 		return nil, err
 	}
 
 	header := make(http.Header)
-	header.Add("Sec-WebSocket-Protocol", "chat, superchat")
+	header.Add("Sec-WebSocket-Protocol", frameSubprotocol)
 	header.Add("Origin", u.String())
 	if headers != nil {
 		for k, v := range headers {
@@ -74,13 +97,21 @@ func createWS(serverURL string, headers map[string]string, h HubConnection) (Con
 		}
 	}
 
+	if isTCPURL(u) {
+		conn, r, codec, err := dialTCP(u, header, config, &BinaryCodec{})
+		if err != nil {
+			return nil, err
+		}
+		return newTCPConnection(conn, r, h, true, options, codec), nil
+	}
+
 	conn, err := net.Dial("tcp", u.Host)
 	if err != nil {
 		return nil, err
 	}
-	ws, _, err := websocket.NewClient(conn, u, header, bufferSize, bufferSize)
+	ws, _, err := websocket.NewClient(conn, u, header, options.ReadBufferSize, options.WriteBufferSize)
 	if err != nil {
 		return nil, err
 	}
-	return newWSConnection(ws, h, true), nil
+	return newWSConnection(ws, h, true, options), nil
 }
@@ -1,8 +1,11 @@
 package conductor
 
+import "sync"
+
 // Storage is the based interface for handling data storage.
+// The hub calls it from several goroutines at once, so it has to be safe for concurrent use.
 type Storage interface {
-	Store(conn Connection, message *Message)          //user on this connection wrote a message to a channel.
+	Store(conn Connection, message *Message)          //user on this connection wrote a message to a channel. The Sequence and Timestamp are already stamped.
 	SentTo(sender, conn Connection, message *Message) //a connection sent a message to the other connection.
 }
 
@@ -10,6 +13,7 @@ type Storage interface {
 // It simply stores the last X messages for each channel.
 // You probably shouldn't use this in production.
 type SimpleStorage struct {
+	mu       sync.Mutex
 	channels map[string][]Message
 	limit    int
 }
@@ -25,6 +29,8 @@ func NewSimpleStorage(limit int) *SimpleStorage {
 // Store puts the X amount of messages in the list
 func (s *SimpleStorage) Store(conn Connection, message *Message) {
 	//store the messages!
+	s.mu.Lock()
+	defer s.mu.Unlock()
 	messages := s.channels[message.ChannelName]
 	messages = append(messages, *message)
 
@@ -36,7 +42,9 @@ func (s *SimpleStorage) Store(conn Connection, message *Message) {
 
 // Get retrieves the messages for that channel
 func (s *SimpleStorage) Get(channelName string) []Message {
-	return s.channels[channelName]
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return append([]Message(nil), s.channels[channelName]...)
 }
 
 // SentTo does nothing in simple storage.
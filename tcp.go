@@ -0,0 +1,336 @@
+package conductor
+
+import (
+	"bufio"
+	"crypto/tls"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Raw TCP connections skip the websocket upgrade. The peer sends an HTTP request as the handshake, so
+// ConnectionAuth sees the same *http.Request it would for a websocket, and the server answers with an HTTP response.
+// A 101 status means the handshake worked. After that, every message is a frame: a 4 byte big-endian length
+// followed by the message encoded with the codec the server picked. An empty frame is a heartbeat, which
+// keeps the connection from timing out when nothing else is being sent.
+const (
+	// tcpProtocol is what the Upgrade header of the handshake asks for.
+	tcpProtocol = "conductor-tcp"
+
+	// tcpCodecHeader has the codecs the peer offers in the request and the one the server picked in the response,
+	// like Sec-WebSocket-Protocol does for websockets.
+	tcpCodecHeader = "Conductor-Codec"
+
+	// how long the handshake has before the connection is dropped.
+	handshakeTimeout = 10 * time.Second
+
+	// the size of the length in front of every frame.
+	frameHeaderSize = 4
+
+	// the most bytes of the handshake the server reads, the same as net/http allows for the headers of a request.
+	maxHandshakeSize = http.DefaultMaxHeaderBytes
+)
+
+// ErrFrameTooLarge is returned when a raw TCP frame is bigger than the MaxMessageSize of the connection.
+var ErrFrameTooLarge = errors.New("conductor: frame is too large")
+
+// errHandshakeTooLarge is returned by a handshakeReader once the handshake has read all it is allowed to.
+var errHandshakeTooLarge = errors.New("conductor: handshake is too large")
+
+// handshakeReader limits how much of the connection the handshake can read, since it is read before ConnectionAuth
+// gets a say. Once the handshake is done, lift removes the limit for the frames.
+type handshakeReader struct {
+	r         io.Reader
+	remaining int64
+	lifted    bool
+}
+
+func (h *handshakeReader) Read(p []byte) (int, error) {
+	if h.lifted {
+		return h.r.Read(p)
+	}
+	if h.remaining <= 0 {
+		return 0, errHandshakeTooLarge
+	}
+	if int64(len(p)) > h.remaining {
+		p = p[:h.remaining]
+	}
+	n, err := h.r.Read(p)
+	h.remaining -= int64(n)
+	return n, err
+}
+
+// lift removes the limit. It has to be called from the goroutine reading.
+func (h *handshakeReader) lift() {
+	h.lifted = true
+}
+
+// isTCPURL checks if the URL is for a raw TCP (tcp://) or TLS (tls://) connection instead of a websocket.
+func isTCPURL(u *url.URL) bool {
+	return u.Scheme == "tcp" || u.Scheme == "tls"
+}
+
+// readFrame reads the next frame. limit is the biggest frame allowed, or 0 for no limit.
+func readFrame(r *bufio.Reader, limit int64) ([]byte, error) {
+	var header [frameHeaderSize]byte
+	if _, err := io.ReadFull(r, header[:]); err != nil {
+		return nil, err
+	}
+	size := binary.BigEndian.Uint32(header[:])
+	if limit > 0 && int64(size) > limit {
+		return nil, ErrFrameTooLarge
+	}
+	buf := make([]byte, size)
+	if _, err := io.ReadFull(r, buf); err != nil {
+		return nil, err
+	}
+	return buf, nil
+}
+
+// writeFrame writes the frame to the buffer. It is on the caller to flush it.
+func writeFrame(w *bufio.Writer, buf []byte) error {
+	var header [frameHeaderSize]byte
+	binary.BigEndian.PutUint32(header[:], uint32(len(buf)))
+	if _, err := w.Write(header[:]); err != nil {
+		return err
+	}
+	_, err := w.Write(buf)
+	return err
+}
+
+// pickCodec returns the first codec of the server the peer offered, like the websocket upgrader does with subprotocols.
+// Peers that offered nothing we know get the BinaryCodec.
+func pickCodec(offered []string) Codec {
+	for _, c := range codecs {
+		for _, value := range offered {
+			for _, name := range strings.Split(value, ",") {
+				if strings.TrimSpace(name) == c.Name() {
+					return c
+				}
+			}
+		}
+	}
+	return &BinaryCodec{}
+}
+
+// writeHandshakeResponse answers the handshake. Only a 101 status has the codec the server picked.
+func writeHandshakeResponse(conn net.Conn, status int, codec Codec) error {
+	resp := &http.Response{StatusCode: status, ProtoMajor: 1, ProtoMinor: 1, Header: make(http.Header)}
+	if status == http.StatusSwitchingProtocols {
+		resp.Header.Set("Upgrade", tcpProtocol)
+		resp.Header.Set("Connection", "Upgrade")
+		resp.Header.Set(tcpCodecHeader, codec.Name())
+	} else {
+		resp.Header.Set("Connection", "close")
+	}
+	conn.SetWriteDeadline(time.Now().Add(handshakeTimeout))
+	return resp.Write(conn)
+}
+
+// dialTCP opens a raw TCP (tcp://) or TLS (tls://) connection to the server and does the handshake.
+// The headers are sent with the handshake request, along with the codec offered.
+// It returns the connection, the reader to read frames from (the handshake might have buffered some already)
+// and the codec the server picked. config is used for tls:// URLs, nil uses the system roots.
+func dialTCP(u *url.URL, header http.Header, config *tls.Config, offered Codec) (net.Conn, *bufio.Reader, Codec, error) {
+	var conn net.Conn
+	var err error
+	dialer := &net.Dialer{Timeout: handshakeTimeout}
+	if u.Scheme == "tls" {
+		if config == nil {
+			config = &tls.Config{ServerName: u.Hostname()}
+		}
+		conn, err = tls.DialWithDialer(dialer, "tcp", u.Host, config)
+	} else {
+		conn, err = dialer.Dial("tcp", u.Host)
+	}
+	if err != nil {
+		return nil, nil, nil, err
+	}
+
+	req := &http.Request{Method: "GET", URL: &url.URL{Path: u.Path, RawQuery: u.RawQuery}, Host: u.Host,
+		Proto: "HTTP/1.1", ProtoMajor: 1, ProtoMinor: 1, Header: make(http.Header)}
+	for k, v := range header {
+		req.Header[k] = v
+	}
+	req.Header.Set("Upgrade", tcpProtocol)
+	req.Header.Set("Connection", "Upgrade")
+	req.Header.Set(tcpCodecHeader, offered.Name())
+
+	conn.SetDeadline(time.Now().Add(handshakeTimeout))
+	if err := req.Write(conn); err != nil {
+		conn.Close()
+		return nil, nil, nil, err
+	}
+	r := bufio.NewReader(conn)
+	resp, err := http.ReadResponse(r, req)
+	if err != nil {
+		conn.Close()
+		return nil, nil, nil, err
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusSwitchingProtocols {
+		conn.Close()
+		return nil, nil, nil, fmt.Errorf("conductor: handshake failed: %s", resp.Status)
+	}
+	conn.SetDeadline(time.Time{})
+	picked := resp.Header.Get(tcpCodecHeader)
+	if picked == offered.Name() {
+		return conn, r, offered, nil
+	}
+	return conn, r, pickCodec([]string{picked}), nil
+}
+
+// tcpconnection is a Connection over raw TCP (or TLS), using length prefixed frames instead of websocket frames.
+type tcpconnection struct {
+	// the underlining network connection and the reader holding whatever the handshake buffered.
+	conn   net.Conn
+	reader *bufio.Reader
+
+	// the ID, hub, channels, codec, limits and outbound queue.
+	queuedConnection
+}
+
+// newTCPConnection creates a tcpconnection on a network connection that finished its handshake.
+// reader is the reader the handshake was read with, since it might have buffered the first frames.
+func newTCPConnection(conn net.Conn, reader *bufio.Reader, h HubConnection, isSister bool, options ServerOptions, codec Codec) *tcpconnection {
+	c := &tcpconnection{conn: conn, reader: reader}
+	c.setup(c, h, isSister, codec, options)
+	return c
+}
+
+// ReadLoop reads frames and forwards the messages to the hub as they come in.
+// It also starts the writer goroutine. Any frame, heartbeats included, keeps the connection from timing out.
+func (c *tcpconnection) ReadLoop(hub HubConnection) {
+	go c.writeLoop()
+
+	for {
+		c.conn.SetReadDeadline(time.Now().Add(c.options.PongWait))
+		buf, err := readFrame(c.reader, c.options.MaxMessageSize)
+		if err != nil {
+			c.Disconnect()
+			break
+		}
+		if len(buf) == 0 {
+			continue // heartbeat.
+		}
+		mess, err := c.decodeMessage(buf)
+		if err != nil {
+			continue // drop the frame instead of handing a half decoded message to the hub.
+		}
+		c.forward(hub, mess)
+	}
+}
+
+// writeLoop is the only thing that writes to the connection. It drains the queue and sends heartbeats.
+// Frames are buffered and only flushed once the queue is empty, so a burst goes out in as few writes as it can.
+// If a write fails the connection is closed, which ends the read loop and disconnects the connection.
+func (c *tcpconnection) writeLoop() {
+	ticker := time.NewTicker(c.options.PingPeriod)
+	defer ticker.Stop()
+	w := bufio.NewWriterSize(c.conn, c.options.WriteBufferSize)
+
+	for {
+		select {
+		case out := <-c.queue.messages:
+			c.conn.SetWriteDeadline(time.Now().Add(c.options.WriteWait))
+			err := c.writeOutbound(w, out)
+			if err == nil && len(c.queue.messages) == 0 {
+				err = w.Flush()
+			}
+			if err != nil {
+				c.conn.Close()
+				return
+			}
+		case <-ticker.C:
+			c.conn.SetWriteDeadline(time.Now().Add(c.options.WriteWait))
+			if err := writeFrame(w, nil); err != nil || w.Flush() != nil {
+				c.conn.Close()
+				return
+			}
+		case <-c.queue.done:
+			c.flush(w)
+			c.conn.Close()
+			return
+		}
+	}
+}
+
+// writeOutbound writes a message from the queue to the buffer.
+func (c *tcpconnection) writeOutbound(w *bufio.Writer, out outbound) error {
+	return c.writeEncoded(out, func(buf []byte) error {
+		return writeFrame(w, buf)
+	})
+}
+
+// flush writes what is left in the queue, unless the connection is being dropped for being too slow.
+// There are no close frames on raw TCP, so the peer finds out the connection is gone when it is closed.
+func (c *tcpconnection) flush(w *bufio.Writer) {
+	if c.queue.closeReason() == ErrSlowConsumer {
+		return
+	}
+	c.conn.SetWriteDeadline(time.Now().Add(c.options.WriteWait))
+	for {
+		select {
+		case out := <-c.queue.messages:
+			if err := c.writeOutbound(w, out); err != nil {
+				return
+			}
+		default:
+			w.Flush()
+			return
+		}
+	}
+}
+
+// tcpTransport is the Client side of a raw TCP connection.
+// It answers the server's heartbeats, since the server drops connections it doesn't hear from.
+type tcpTransport struct {
+	conn   net.Conn
+	reader *bufio.Reader
+
+	// the biggest frame the server can send.
+	limit int64
+
+	// the read loop answers heartbeats while the client writes, so writes are guarded.
+	mu     sync.Mutex
+	writer *bufio.Writer
+}
+
+func newTCPTransport(conn net.Conn, reader *bufio.Reader, limit int64) *tcpTransport {
+	return &tcpTransport{conn: conn, reader: reader, limit: limit, writer: bufio.NewWriterSize(conn, bufferSize)}
+}
+
+func (t *tcpTransport) readMessage() ([]byte, error) {
+	for {
+		buf, err := readFrame(t.reader, t.limit)
+		if err != nil {
+			return nil, err
+		}
+		if len(buf) > 0 {
+			return buf, nil
+		}
+		if err := t.writeMessage(nil, nil); err != nil {
+			return nil, err
+		}
+	}
+}
+
+func (t *tcpTransport) writeMessage(codec Codec, buf []byte) error {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if err := writeFrame(t.writer, buf); err != nil {
+		return err
+	}
+	return t.writer.Flush()
+}
+
+func (t *tcpTransport) close() error {
+	return t.conn.Close()
+}
@@ -0,0 +1,275 @@
+package conductor
+
+import (
+	"bufio"
+	"bytes"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"testing"
+	"time"
+)
+
+// TestFrames checks frames, heartbeats included, read back as they were written, and the limits of readFrame.
+func TestFrames(t *testing.T) {
+	var buf bytes.Buffer
+	w := bufio.NewWriter(&buf)
+	frames := [][]byte{[]byte("first"), nil, bytes.Repeat([]byte("x"), 70000), []byte("last")}
+	for _, frame := range frames {
+		if err := writeFrame(w, frame); err != nil {
+			t.Fatal(err)
+		}
+	}
+	w.Flush()
+	wire := append([]byte(nil), buf.Bytes()...)
+
+	r := bufio.NewReader(&buf)
+	for i, frame := range frames {
+		got, err := readFrame(r, 0)
+		if err != nil {
+			t.Fatalf("frame %d: %v", i, err)
+		}
+		if !bytes.Equal(got, frame) {
+			t.Fatalf("frame %d: got %d bytes, want %d", i, len(got), len(frame))
+		}
+	}
+	if _, err := readFrame(r, 0); err != io.EOF {
+		t.Fatalf("read after the last frame: %v", err)
+	}
+
+	r = bufio.NewReader(bytes.NewReader(wire))
+	readFrame(r, 0)
+	readFrame(r, 0)
+	if _, err := readFrame(r, 65536); err != ErrFrameTooLarge {
+		t.Fatalf("frame over the limit: %v", err)
+	}
+
+	r = bufio.NewReader(bytes.NewReader(wire[:frameHeaderSize+2]))
+	if _, err := readFrame(r, 0); err != io.ErrUnexpectedEOF {
+		t.Fatalf("truncated frame: %v", err)
+	}
+}
+
+// denyAuth turns every connection away.
+type denyAuth struct {
+	SimpleAuth
+}
+
+func (a *denyAuth) IsValid(r *http.Request) bool {
+	return false
+}
+
+// tcpHandshake connects to the raw TCP handler of the server over a pipe and sends the handshake with header.
+func tcpHandshake(t *testing.T, s *Server, header http.Header) (net.Conn, *bufio.Reader, *http.Response) {
+	client, server := net.Pipe()
+	go s.tcpHandler(server)
+	req := &http.Request{Method: "GET", URL: &url.URL{Path: "/"}, Host: "conductor",
+		Proto: "HTTP/1.1", ProtoMajor: 1, ProtoMinor: 1, Header: header}
+	client.SetDeadline(time.Now().Add(time.Second))
+	if err := req.Write(client); err != nil {
+		t.Fatal(err)
+	}
+	r := bufio.NewReader(client)
+	resp, err := http.ReadResponse(r, req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	client.SetDeadline(time.Time{})
+	return client, r, resp
+}
+
+// TestTCPHandshakeRefused checks the handshakes the server turns away get an error status and a closed connection.
+func TestTCPHandshakeRefused(t *testing.T) {
+	tests := []struct {
+		name   string
+		auth   ConnectionAuth
+		header http.Header
+		status int
+	}{
+		{"plain http", NewSimpleAuth(), http.Header{}, http.StatusBadRequest},
+		{"websocket upgrade", NewSimpleAuth(), http.Header{"Upgrade": {"websocket"}}, http.StatusBadRequest},
+		{"not valid", &denyAuth{}, http.Header{"Upgrade": {tcpProtocol}}, http.StatusUnauthorized},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			s := New(0, nil, test.auth, nil, nil, nil)
+			s.Start(false)
+			conn, r, resp := tcpHandshake(t, s, test.header)
+			defer conn.Close()
+			if resp.StatusCode != test.status {
+				t.Fatalf("status %d, want %d", resp.StatusCode, test.status)
+			}
+			if resp.Header.Get(tcpCodecHeader) != "" {
+				t.Fatalf("refused handshake picked codec %q", resp.Header.Get(tcpCodecHeader))
+			}
+			conn.SetReadDeadline(time.Now().Add(time.Second))
+			if _, err := r.ReadByte(); err != io.EOF {
+				t.Fatalf("connection was not closed: %v", err)
+			}
+		})
+	}
+}
+
+// tcpPeer is the client end of a pipe to the raw TCP handler, reading frames on its own so heartbeats don't block the server.
+type tcpPeer struct {
+	conn   net.Conn
+	codec  Codec
+	frames chan []byte
+}
+
+func newTCPPeer(t *testing.T, s *Server, codec Codec) *tcpPeer {
+	conn, r, resp := tcpHandshake(t, s, http.Header{"Upgrade": {tcpProtocol}, tcpCodecHeader: {codec.Name()}})
+	if resp.StatusCode != http.StatusSwitchingProtocols {
+		t.Fatalf("handshake status %d", resp.StatusCode)
+	}
+	if picked := resp.Header.Get(tcpCodecHeader); picked != codec.Name() {
+		t.Fatalf("server picked %q, want %q", picked, codec.Name())
+	}
+	p := &tcpPeer{conn: conn, codec: codec, frames: make(chan []byte, 16)}
+	go func() {
+		defer close(p.frames)
+		for {
+			buf, err := readFrame(r, 0)
+			if err != nil {
+				return
+			}
+			p.frames <- buf
+		}
+	}()
+	return p
+}
+
+func (p *tcpPeer) send(t *testing.T, message *Message) {
+	buf, err := p.codec.Marshal(message)
+	if err != nil {
+		t.Fatal(err)
+	}
+	w := bufio.NewWriter(p.conn)
+	if err := writeFrame(w, buf); err != nil {
+		t.Fatal(err)
+	}
+	if err := w.Flush(); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// next returns the next message, skipping heartbeats.
+func (p *tcpPeer) next(t *testing.T) *Message {
+	timeout := time.After(time.Second)
+	for {
+		select {
+		case buf, ok := <-p.frames:
+			if !ok {
+				t.Fatal("connection closed")
+			}
+			if len(buf) == 0 {
+				continue
+			}
+			message, err := p.codec.Unmarshal(buf)
+			if err != nil {
+				t.Fatal(err)
+			}
+			return message
+		case <-timeout:
+			t.Fatal("timed out waiting for a message")
+		}
+	}
+}
+
+// TestTCPConnection binds and writes over raw TCP, in the codec the peer offered.
+func TestTCPConnection(t *testing.T) {
+	s := New(0, nil, NewSimpleAuth(), nil, nil, nil)
+	s.Start(false)
+	a := newTCPPeer(t, s, &JSONCodec{})
+	defer a.conn.Close()
+	b := newTCPPeer(t, s, &BinaryCodec{})
+	defer b.conn.Close()
+
+	for _, p := range []*tcpPeer{a, b} {
+		p.send(t, &Message{Opcode: BindOpcode, ChannelName: "chat", Uuid: newUUID(), Flags: FlagAckRequested})
+		if ack := p.next(t); ack.Opcode != AckOpcode {
+			t.Fatalf("bind answered with opcode %d", ack.Opcode)
+		}
+	}
+	a.send(t, &Message{Opcode: WriteOpcode, ChannelName: "chat", Uuid: newUUID(), Body: []byte("hi")})
+	if got := b.next(t); got.Opcode != WriteOpcode || string(got.Body) != "hi" {
+		t.Fatalf("got opcode %d body %q", got.Opcode, got.Body)
+	}
+}
+
+// TestTCPHeartbeat checks the server sends heartbeats, keeps peers that send them and drops peers that go quiet.
+func TestTCPHeartbeat(t *testing.T) {
+	s := New(0, nil, NewSimpleAuth(), nil, nil, nil)
+	s.Options.PongWait = 200 * time.Millisecond
+	s.Options.PingPeriod = 50 * time.Millisecond
+	s.Start(false)
+
+	alive := newTCPPeer(t, s, &BinaryCodec{})
+	defer alive.conn.Close()
+	select {
+	case buf := <-alive.frames:
+		if len(buf) != 0 {
+			t.Fatalf("got a %d byte frame instead of a heartbeat", len(buf))
+		}
+	case <-time.After(time.Second):
+		t.Fatal("no heartbeat")
+	}
+	w := bufio.NewWriter(alive.conn)
+	for i := 0; i < 10; i++ {
+		time.Sleep(50 * time.Millisecond)
+		writeFrame(w, nil)
+		if err := w.Flush(); err != nil {
+			t.Fatalf("peer sending heartbeats was dropped: %v", err)
+		}
+	}
+	alive.send(t, &Message{Opcode: BindOpcode, ChannelName: "chat", Uuid: newUUID(), Flags: FlagAckRequested})
+	if ack := alive.next(t); ack.Opcode != AckOpcode {
+		t.Fatalf("bind answered with opcode %d", ack.Opcode)
+	}
+
+	quiet := newTCPPeer(t, s, &BinaryCodec{})
+	defer quiet.conn.Close()
+	timeout := time.After(2 * time.Second)
+	for {
+		select {
+		case _, ok := <-quiet.frames:
+			if !ok {
+				return
+			}
+		case <-timeout:
+			t.Fatal("quiet peer was not dropped")
+		}
+	}
+}
+
+// TestTCPHandshakeLimit checks the server stops reading a handshake that is too large, instead of buffering it all.
+func TestTCPHandshakeLimit(t *testing.T) {
+	s := New(0, nil, NewSimpleAuth(), nil, nil, nil)
+	s.Start(false)
+	client, server := net.Pipe()
+	done := make(chan struct{})
+	go func() {
+		s.tcpHandler(server)
+		close(done)
+	}()
+
+	written := 0
+	if n, err := client.Write([]byte("GET / HTTP/1.1\r\nHost: conductor\r\nUpgrade: conductor-tcp\r\nX-Padding: ")); err == nil {
+		written += n
+	}
+	chunk := bytes.Repeat([]byte("a"), 4096)
+	for written < 4*maxHandshakeSize {
+		n, err := client.Write(chunk)
+		written += n
+		if err != nil {
+			break
+		}
+	}
+	<-done
+	if limit := maxHandshakeSize + s.connectionOptions().ReadBufferSize + len(chunk); written > limit {
+		t.Fatalf("server read %d bytes of handshake, limit is %d", written, limit)
+	}
+	client.Close()
+}
@@ -0,0 +1,152 @@
+package conductor
+
+import (
+	"encoding/json"
+	"unicode"
+	"unicode/utf8"
+)
+
+// The machine readable codes of a ProtocolError.
+const (
+	ErrCodeUnknownOpcode  = "unknown_opcode"  // the opcode isn't one a client can send.
+	ErrCodeInvalidUuid    = "invalid_uuid"    // the uuid is missing or isn't a canonical UUID.
+	ErrCodeInvalidChannel = "invalid_channel" // the channel name is empty, too long or has characters that aren't allowed.
+	ErrCodeBodyTooLarge   = "body_too_large"  // the body is over the size allowed.
+	ErrCodeUnauthorized   = "unauthorized"    // the ConnectionAuth didn't allow the bind or write.
+
+	ErrCodePresenceDisabled = "presence_disabled" // the channel of a presence query doesn't have presence.
+	ErrCodeUnknownRecipient = "unknown_recipient" // nobody has the connection ID or identity a direct message is addressed to.
+	ErrCodeChannelFull      = "channel_full"      // the channel has the most subscribers its ChannelPolicy allows.
+	ErrCodeEncodeFailed     = "encode_failed"     // the server couldn't encode a message for the connection's codec, so it sent this instead.
+	ErrCodeDropped          = "dropped"           // a Middleware dropped the message instead of passing it on.
+	ErrCodeDuplicate        = "duplicate"         // the message has the Uuid of one the hub already handled, so it was ignored. The first answer stands.
+)
+
+// ProtocolError is the body of an ErrorOpcode or NackOpcode message.
+// The Uuid of the ErrorOpcode or NackOpcode message is the Uuid of the message that was rejected.
+type ProtocolError struct {
+	Code   string `json:"code"`   // Code is one of the ErrCode constants, so clients can switch on it.
+	Reason string `json:"reason"` // Reason is a human readable description of the problem.
+	Uuid   string `json:"-"`      // Uuid is the Uuid of the rejected message.
+}
+
+func (e *ProtocolError) Error() string {
+	return "conductor: " + e.Code + ": " + e.Reason
+}
+
+// errorMessage builds the ErrorOpcode message for the rejected message.
+func (e *ProtocolError) errorMessage(rejected *Message) *Message {
+	b, _ := json.Marshal(e)
+	return &Message{Opcode: ErrorOpcode, ChannelName: rejected.ChannelName, Uuid: rejected.Uuid, Body: b}
+}
+
+// nackMessage builds the NackOpcode message for the refused message.
+func (e *ProtocolError) nackMessage(refused *Message) *Message {
+	m := e.errorMessage(refused)
+	m.Opcode = NackOpcode
+	return m
+}
+
+// ParseProtocolError decodes the ProtocolError out of an ErrorOpcode or NackOpcode message.
+func ParseProtocolError(message *Message) *ProtocolError {
+	var e ProtocolError
+	if err := json.Unmarshal(message.Body, &e); err != nil {
+		e.Code = "unknown"
+		e.Reason = string(message.Body)
+	}
+	e.Uuid = message.Uuid
+	return &e
+}
+
+// MessageValidator is the based interface for validating messages before the hub processes them.
+// Messages that don't pass are dropped and the connection gets an ErrorOpcode message back.
+type MessageValidator interface {
+	Validate(conn Connection, message *Message) *ProtocolError // Validate is called on every message from a client, so optimizing it is highly recommended.
+}
+
+// StandardValidator is the default implementation of MessageValidator.
+// It checks the opcode, the uuid format, the channel name rules (patterns included) and the body size.
+type StandardValidator struct {
+	MaxChannelNameSize int // MaxChannelNameSize is the most bytes allowed in a channel name.
+	MaxBodySize        int // MaxBodySize is the most bytes allowed in a body. Zero leaves it to the MaxMessageSize of the ServerOptions.
+}
+
+// NewStandardValidator creates a StandardValidator with sensible limits.
+func NewStandardValidator() *StandardValidator {
+	return &StandardValidator{MaxChannelNameSize: defaultMaxChannelNameSize}
+}
+
+// Validate checks the message follows the rules.
+func (v *StandardValidator) Validate(conn Connection, message *Message) *ProtocolError {
+	needsChannel := false
+	switch message.Opcode {
+	case BindOpcode, UnbindOpcode, WriteOpcode, StreamStartOpcode, StreamEndOpcode, StreamWriteOpcode, PresenceQueryOpcode, DirectOpcode:
+		needsChannel = true
+	case ServerOpcode:
+	default:
+		return &ProtocolError{Code: ErrCodeUnknownOpcode, Reason: "opcode can't be sent by a client"}
+	}
+
+	if !isUUID(message.Uuid) {
+		return &ProtocolError{Code: ErrCodeInvalidUuid, Reason: "uuid must be a canonical UUID"}
+	}
+
+	if needsChannel {
+		if message.ChannelName == "" {
+			return &ProtocolError{Code: ErrCodeInvalidChannel, Reason: "channel name is required"} // the recipient of a direct message is in the channel name too.
+		}
+		if over(len(message.ChannelName), v.MaxChannelNameSize) {
+			return &ProtocolError{Code: ErrCodeInvalidChannel, Reason: "channel name is too long"}
+		}
+		if !validChannelName(message.ChannelName) {
+			return &ProtocolError{Code: ErrCodeInvalidChannel, Reason: "channel name has characters that aren't allowed"}
+		}
+		if IsPattern(message.ChannelName) {
+			if message.Opcode != BindOpcode && message.Opcode != UnbindOpcode {
+				return &ProtocolError{Code: ErrCodeInvalidChannel, Reason: "only bind and unbind can use a pattern"}
+			}
+			if !validPattern(message.ChannelName) {
+				return &ProtocolError{Code: ErrCodeInvalidChannel, Reason: "pattern can't have empty tokens and > must be last"}
+			}
+		}
+	}
+
+	if over(len(message.Body), v.MaxBodySize) {
+		return &ProtocolError{Code: ErrCodeBodyTooLarge, Reason: "body is too large"}
+	}
+	return nil
+}
+
+// validChannelName makes sure the name is UTF-8 without spaces or control characters.
+func validChannelName(name string) bool {
+	if !utf8.ValidString(name) {
+		return false
+	}
+	for _, r := range name {
+		if unicode.IsSpace(r) || unicode.IsControl(r) {
+			return false
+		}
+	}
+	return true
+}
+
+// isUUID checks for the canonical 8-4-4-4-12 hex form, like the ones newUUID creates.
+func isUUID(s string) bool {
+	if len(s) != 36 {
+		return false
+	}
+	for i := 0; i < len(s); i++ {
+		switch i {
+		case 8, 13, 18, 23:
+			if s[i] != '-' {
+				return false
+			}
+		default:
+			c := s[i]
+			if !('0' <= c && c <= '9' || 'a' <= c && c <= 'f' || 'A' <= c && c <= 'F') {
+				return false
+			}
+		}
+	}
+	return true
+}